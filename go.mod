@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/google/uuid v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/onsi/ginkgo v1.15.1
 	github.com/onsi/gomega v1.11.0
 	github.com/pkg/errors v0.9.1
@@ -66,6 +66,7 @@ func setupCli(baseCmd *cobra.Command) {
 	baseCmd.PersistentFlags().StringVarP(&maxSegmentSizeBytes, "stream-max-segment-size-bytes", "", "500MB", "Stream segment size bytes, e.g. 10MB, 1GB, etc.")
 	baseCmd.AddCommand(versionCmd)
 	baseCmd.AddCommand(newSilent())
+	baseCmd.AddCommand(newMirror())
 }
 
 //Execute is the entrypoint of the commands
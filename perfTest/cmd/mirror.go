@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/mirror"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+	"github.com/spf13/cobra"
+)
+
+var (
+	mirrorTargetUris    []string
+	mirrorName          string
+	mirrorSourceStream  string
+	mirrorTargetStream  string
+	mirrorOffset        string
+	mirrorDeclareTarget bool
+)
+
+func newMirror() *cobra.Command {
+	var mirrorCmd = &cobra.Command{
+		Use:   "mirror",
+		Short: "Copy a stream to another stream, also of another cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return startMirror()
+		},
+	}
+	mirrorCmd.Flags().StringSliceVarP(&mirrorTargetUris, "target-uris", "", nil, "Target broker URLs, the source ones when empty")
+	mirrorCmd.Flags().StringVarP(&mirrorName, "name", "", "perf-test-go-mirror", "Mirror name, used for the source offset and the target deduplication")
+	mirrorCmd.Flags().StringVarP(&mirrorSourceStream, "source-stream", "", "perf-test-go", "Source stream")
+	mirrorCmd.Flags().StringVarP(&mirrorTargetStream, "target-stream", "", "perf-test-go-mirror", "Target stream")
+	mirrorCmd.Flags().StringVarP(&mirrorOffset, "offset", "", "first", "Offset of the first run: first, last, next or a number")
+	mirrorCmd.Flags().BoolVarP(&mirrorDeclareTarget, "declare-target", "", true, "Declare the target stream")
+	return mirrorCmd
+}
+
+func parseMirrorOffset(offset string) (stream.OffsetSpecification, error) {
+	switch offset {
+	case "first":
+		return stream.OffsetSpecification{}.First(), nil
+	case "last":
+		return stream.OffsetSpecification{}.Last(), nil
+	case "next":
+		return stream.OffsetSpecification{}.Next(), nil
+	}
+	value, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || value < 0 {
+		return stream.OffsetSpecification{}, fmt.Errorf("invalid offset: %s", offset)
+	}
+	return stream.OffsetSpecification{}.Offset(value), nil
+}
+
+func startMirror() error {
+	if debugLogs {
+		stream.SetLevelInfo(logs.DEBUG)
+	}
+	offset, err := parseMirrorOffset(mirrorOffset)
+	if err != nil {
+		logError("%s", err)
+		return err
+	}
+	targetUris := mirrorTargetUris
+	if len(targetUris) == 0 {
+		targetUris = rabbitmqBrokerUrl
+	}
+	logInfo("Mirror %s (%s), source: %s %s, target: %s %s", mirrorName, stream.ClientVersion,
+		rabbitmqBrokerUrl, mirrorSourceStream, targetUris, mirrorTargetStream)
+
+	source, err := stream.NewEnvironment(stream.NewEnvironmentOptions().SetUris(rabbitmqBrokerUrl))
+	if err != nil {
+		logError("Error source connection: %s", err)
+		return err
+	}
+	defer source.Close()
+	target, err := stream.NewEnvironment(stream.NewEnvironmentOptions().SetUris(targetUris))
+	if err != nil {
+		logError("Error target connection: %s", err)
+		return err
+	}
+	defer target.Close()
+
+	if mirrorDeclareTarget {
+		err = target.DeclareStreamIfNotExists(mirrorTargetStream, nil)
+		if err != nil {
+			logError("Error declaring the target stream: %s", err)
+			return err
+		}
+	}
+
+	m, err := mirror.NewMirror(source, target,
+		mirror.NewOptions(mirrorName, mirrorSourceStream, mirrorTargetStream).SetOffset(offset))
+	if err != nil {
+		logError("Error starting the mirror: %s", err)
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logInfo("Mirrored messages: %d", m.Mirrored())
+		case <-signals:
+			err = m.Close()
+			logInfo("Mirror closed, mirrored messages: %d", m.Mirrored())
+			return err
+		case <-m.Done():
+			err = m.Err()
+			if err != nil {
+				logError("Mirror stopped: %s", err)
+			}
+			return err
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/ha"
@@ -156,13 +157,13 @@ func initStreams() error {
 				SetMaxLengthBytes(stream.ByteCapacity{}.From(maxLengthBytes)).
 				SetMaxSegmentSizeBytes(stream.ByteCapacity{}.From(maxSegmentSizeBytes)))
 		if err != nil {
-			if err == stream.PreconditionFailed {
+			if errors.Is(err, stream.PreconditionFailed) {
 				logError("The stream: %s already exist with different parameters", streamName)
 				_ = env.Close()
 				return err
 			}
 
-			if err != stream.StreamAlreadyExists {
+			if !errors.Is(err, stream.StreamAlreadyExists) {
 				logError("Error during stream %s creation, err: %s", streamName, err)
 				_ = env.Close()
 				return err
@@ -402,6 +402,14 @@ func NewMessage(data []byte) *AMQP10 {
 	}
 }
 
+// FromMessage wraps a received message, so it can be published again
+func FromMessage(message *Message) *AMQP10 {
+	return &AMQP10{
+		message:      message,
+		publishingId: -1,
+	}
+}
+
 func (amqp *AMQP10) SetPublishingId(id int64) {
 	amqp.publishingId = id
 }
@@ -422,6 +430,14 @@ func (amqp *AMQP10) GetData() [][]byte {
 	return amqp.message.Data
 }
 
+func (amqp *AMQP10) SetApplicationProperties(properties map[string]interface{}) {
+	amqp.message.ApplicationProperties = properties
+}
+
+func (amqp *AMQP10) GetApplicationProperties() map[string]interface{} {
+	return amqp.message.ApplicationProperties
+}
+
 // NewMessage returns a *Message with data as the payload.
 //
 // This constructor is intended as a helper for basic Messages with a
@@ -108,8 +108,8 @@ func (p *ReliableProducer) Send(message message.StreamMessage) error {
 	p.totalSent += 1
 
 	if errW != nil {
-		switch errW {
-		case stream.FrameTooLarge:
+		switch {
+		case errors.Is(errW, stream.FrameTooLarge):
 			{
 				return stream.FrameTooLarge
 			}
@@ -120,22 +120,36 @@ func (p *ReliableProducer) Send(message message.StreamMessage) error {
 	}
 	// tls e non tls  connections have different error message
 	if errW != nil {
-		time.Sleep(200 * time.Millisecond)
-		exists, errS := p.env.StreamExists(p.streamName)
-		if errS != nil {
-			return errS
+		p.producer.FlushUnConfirmedMessages()
+		return p.reconnect()
+	}
 
-		}
-		if exists {
-			time.Sleep(800 * time.Millisecond)
-			p.producer.FlushUnConfirmedMessages()
-			return p.newProducer()
-		} else {
+	return nil
+}
+
+// reconnect creates a new producer following the environment BackoffPolicy,
+// it returns the last error when the policy gives up
+func (p *ReliableProducer) reconnect() error {
+	policy := p.env.BackoffPolicy()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		exists, err := p.env.StreamExists(p.streamName)
+		if err == nil && !exists {
 			return stream.StreamDoesNotExist
 		}
+		if err == nil {
+			err = p.newProducer()
+			if err == nil {
+				return nil
+			}
+		}
+		delay, retry := policy.NextDelay(attempt, time.Since(start))
+		if !retry {
+			return err
+		}
+		fmt.Printf("Reconnect error %s, retry in %s \n", err.Error(), delay)
+		time.Sleep(delay)
 	}
-
-	return nil
 }
 
 func (p *ReliableProducer) IsOpen() bool {
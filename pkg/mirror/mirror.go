@@ -0,0 +1,323 @@
+// Package mirror copies the messages of a stream to another stream,
+// also of another cluster.
+//
+// The source offset is the publishing ID of the copy and the producer of
+// the target stream has the mirror name, so the broker drops the messages
+// already copied when the mirror restarts. The source offset is stored on
+// the source stream, with the mirror name, once the copies are confirmed.
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+)
+
+const (
+	defaultStoreEvery   = 1000
+	defaultCloseTimeout = 10 * time.Second
+)
+
+type Options struct {
+	// Name identifies the mirror: it is the name of the source
+	// consumer and of the target producer. It is mandatory.
+	Name         string
+	SourceStream string
+	TargetStream string
+	// Offset is where the first run starts, the next runs
+	// restart after the stored offset
+	Offset stream.OffsetSpecification
+	// Filter skips the messages when it returns false
+	Filter func(message *amqp.Message, messageContext stream.MessageContext) bool
+	// Transform changes the messages before they are published
+	Transform func(message *amqp.Message, messageContext stream.MessageContext) *amqp.Message
+	// StoreEvery is how many confirmed messages between two offset stores
+	StoreEvery int
+	// CloseTimeout is how long Close waits for the confirmations
+	CloseTimeout time.Duration
+}
+
+func NewOptions(name string, sourceStream string, targetStream string) *Options {
+	return &Options{
+		Name:         name,
+		SourceStream: sourceStream,
+		TargetStream: targetStream,
+		Offset:       stream.OffsetSpecification{}.First(),
+		StoreEvery:   defaultStoreEvery,
+		CloseTimeout: defaultCloseTimeout,
+	}
+}
+
+func (o *Options) SetOffset(offset stream.OffsetSpecification) *Options {
+	o.Offset = offset
+	return o
+}
+
+func (o *Options) SetFilter(filter func(message *amqp.Message, messageContext stream.MessageContext) bool) *Options {
+	o.Filter = filter
+	return o
+}
+
+func (o *Options) SetTransform(transform func(message *amqp.Message, messageContext stream.MessageContext) *amqp.Message) *Options {
+	o.Transform = transform
+	return o
+}
+
+func (o *Options) SetStoreEvery(storeEvery int) *Options {
+	o.StoreEvery = storeEvery
+	return o
+}
+
+func (o *Options) SetCloseTimeout(closeTimeout time.Duration) *Options {
+	o.CloseTimeout = closeTimeout
+	return o
+}
+
+func (o *Options) validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("the mirror needs a Name")
+	}
+	if o.SourceStream == "" || o.TargetStream == "" {
+		return fmt.Errorf("the mirror needs the SourceStream and the TargetStream")
+	}
+	if o.StoreEvery <= 0 {
+		return fmt.Errorf("StoreEvery must be positive")
+	}
+	if o.CloseTimeout < 0 {
+		return fmt.Errorf("CloseTimeout can't be negative")
+	}
+	return nil
+}
+
+type Mirror struct {
+	options  *Options
+	consumer *stream.Consumer
+	producer *stream.Producer
+
+	mutex *sync.Mutex
+	// source offsets published and not yet confirmed
+	pending map[int64]bool
+	// the last source offset published
+	lastSent int64
+	// the last source offset stored
+	lastStored int64
+	unstored   int
+	mirrored   int64
+	err        error
+	done       chan struct{}
+	closeOnce  *sync.Once
+	closing    int32
+}
+
+// NewMirror starts to copy the messages of options.SourceStream
+// on source to options.TargetStream on target, source and target
+// can be the same environment
+func NewMirror(source *stream.Environment, target *stream.Environment, options *Options) (*Mirror, error) {
+	if options == nil {
+		return nil, fmt.Errorf("the mirror needs the options")
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	m := &Mirror{
+		options:    options,
+		mutex:      &sync.Mutex{},
+		pending:    map[int64]bool{},
+		lastSent:   -1,
+		lastStored: -1,
+		done:       make(chan struct{}),
+		closeOnce:  &sync.Once{},
+	}
+
+	producer, err := target.NewProducer(options.TargetStream,
+		stream.NewProducerOptions().SetProducerName(options.Name))
+	if err != nil {
+		return nil, err
+	}
+	m.producer = producer
+	go m.handleConfirms(producer.NotifyPublishConfirmation())
+
+	consumer, err := m.newConsumer(source, stream.OffsetSpecification{}.LastConsumed())
+	if errors.Is(err, stream.OffsetNotFound) {
+		// the first run
+		consumer, err = m.newConsumer(source, options.Offset)
+	}
+	if err != nil {
+		_ = producer.Close()
+		return nil, err
+	}
+	m.mutex.Lock()
+	m.consumer = consumer
+	m.mutex.Unlock()
+	go m.handleConsumerClose(consumer.NotifyClose())
+	return m, nil
+}
+
+func (m *Mirror) newConsumer(source *stream.Environment, offset stream.OffsetSpecification) (*stream.Consumer, error) {
+	return source.NewConsumer(m.options.SourceStream, m.handleMessage,
+		stream.NewConsumerOptions().SetConsumerName(m.options.Name).
+			SetOffset(offset).ManualCommit())
+}
+
+func (m *Mirror) handleMessage(consumerContext stream.ConsumerContext, message *amqp.Message) {
+	if atomic.LoadInt32(&m.closing) == 1 {
+		return
+	}
+	messageContext := consumerContext.Message
+	if m.options.Filter != nil && !m.options.Filter(message, messageContext) {
+		return
+	}
+	if m.options.Transform != nil {
+		message = m.options.Transform(message, messageContext)
+		if message == nil {
+			return
+		}
+	}
+	streamMessage := amqp.FromMessage(message)
+	// the broker drops the copies already published by the mirror
+	streamMessage.SetPublishingId(messageContext.Offset)
+
+	m.mutex.Lock()
+	m.pending[messageContext.Offset] = true
+	m.lastSent = messageContext.Offset
+	m.mutex.Unlock()
+	if err := m.producer.Send(streamMessage); err != nil {
+		m.fail(err)
+	}
+}
+
+func (m *Mirror) handleConfirms(confirms stream.ChannelPublishConfirm) {
+	for messages := range confirms {
+		for _, message := range messages {
+			if !message.Confirmed {
+				err := message.Err
+				if err == nil {
+					err = fmt.Errorf("message not confirmed")
+				}
+				m.fail(fmt.Errorf("source offset %d: %w", message.SequenceID, err))
+				continue
+			}
+			m.mutex.Lock()
+			delete(m.pending, message.SequenceID)
+			m.unstored++
+			store := m.unstored >= m.options.StoreEvery
+			m.mutex.Unlock()
+			atomic.AddInt64(&m.mirrored, 1)
+			if store {
+				m.storeOffset()
+			}
+		}
+	}
+}
+
+func (m *Mirror) handleConsumerClose(closeCh stream.ChannelClose) {
+	event, ok := <-closeCh
+	if !ok || atomic.LoadInt32(&m.closing) == 1 {
+		return
+	}
+	err := event.Err
+	if err == nil {
+		err = fmt.Errorf("source consumer closed: %s", event.Reason)
+	}
+	m.fail(err)
+}
+
+// safeOffset is the last source offset with all the messages
+// before it confirmed
+func (m *Mirror) safeOffset() int64 {
+	safe := m.lastSent
+	for offset := range m.pending {
+		if offset-1 < safe {
+			safe = offset - 1
+		}
+	}
+	return safe
+}
+
+func (m *Mirror) storeOffset() {
+	m.mutex.Lock()
+	consumer := m.consumer
+	offset := m.safeOffset()
+	// the messages can be confirmed before NewMirror returns
+	if consumer == nil || offset <= m.lastStored {
+		m.mutex.Unlock()
+		return
+	}
+	m.unstored = 0
+	m.lastStored = offset
+	m.mutex.Unlock()
+	if err := consumer.StoreCustomOffset(offset); err != nil {
+		logs.LogWarn("mirror %s, can't store the offset %d: %s", m.options.Name, offset, err)
+	}
+}
+
+// fail stops the mirror, Err returns the error
+func (m *Mirror) fail(err error) {
+	m.mutex.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.mutex.Unlock()
+	logs.LogWarn("mirror %s stopped: %s", m.options.Name, err)
+	go func() {
+		_ = m.Close()
+	}()
+}
+
+// Mirrored is the number of messages copied and confirmed
+func (m *Mirror) Mirrored() int64 {
+	return atomic.LoadInt64(&m.mirrored)
+}
+
+// Done is closed when the mirror stops, by Close or by an error
+func (m *Mirror) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err is the error that stopped the mirror, nil after Close
+func (m *Mirror) Err() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.err
+}
+
+// Close stops the copy, waits for the confirmations of the messages
+// already published, up to CloseTimeout, and stores the source offset
+func (m *Mirror) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		atomic.StoreInt32(&m.closing, 1)
+		deadline := time.Now().Add(m.options.CloseTimeout)
+		// after an error the stored offset stays before the failed message
+		for m.pendingCount() > 0 && m.Err() == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		m.mutex.Lock()
+		consumer := m.consumer
+		m.mutex.Unlock()
+		if consumer != nil {
+			// the offset is stored on the consumer connection
+			m.storeOffset()
+			if errClose := consumer.Close(); errClose != nil && errClose != stream.AlreadyClosed {
+				err = errClose
+			}
+		}
+		if errClose := m.producer.Close(); errClose != nil && errClose != stream.AlreadyClosed && err == nil {
+			err = errClose
+		}
+		close(m.done)
+	})
+	return err
+}
+
+func (m *Mirror) pendingCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.pending)
+}
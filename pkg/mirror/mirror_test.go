@@ -0,0 +1,171 @@
+package mirror
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/message"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+)
+
+var _ = Describe("Mirror", func() {
+
+	It("Safe offset with gaps", func() {
+		m := &Mirror{pending: map[int64]bool{}, lastSent: -1}
+		Expect(m.safeOffset()).To(Equal(int64(-1)))
+		m.lastSent = 9
+		Expect(m.safeOffset()).To(Equal(int64(9)))
+		// the filtered offsets are not pending
+		m.pending[7] = true
+		m.pending[4] = true
+		Expect(m.safeOffset()).To(Equal(int64(3)))
+		delete(m.pending, 4)
+		Expect(m.safeOffset()).To(Equal(int64(6)))
+		delete(m.pending, 7)
+		Expect(m.safeOffset()).To(Equal(int64(9)))
+	})
+
+	It("Validates the options", func() {
+		_, err := NewMirror(nil, nil, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = NewMirror(nil, nil, NewOptions("", "source", "target"))
+		Expect(err).To(HaveOccurred())
+		_, err = NewMirror(nil, nil, NewOptions("mirror", "source", ""))
+		Expect(err).To(HaveOccurred())
+		_, err = NewMirror(nil, nil, NewOptions("mirror", "source", "target").SetStoreEvery(0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Broker", func() {
+		var (
+			env          *stream.Environment
+			sourceStream string
+			targetStream string
+			name         string
+		)
+		BeforeEach(func() {
+			var err error
+			env, err = stream.NewEnvironment(nil)
+			Expect(err).NotTo(HaveOccurred())
+			sourceStream = uuid.New().String()
+			targetStream = uuid.New().String()
+			Expect(env.DeclareStream(sourceStream, nil)).NotTo(HaveOccurred())
+			Expect(env.DeclareStream(targetStream, nil)).NotTo(HaveOccurred())
+			name = uuid.New().String()
+		})
+		AfterEach(func() {
+			Expect(env.DeleteStream(sourceStream)).NotTo(HaveOccurred())
+			Expect(env.DeleteStream(targetStream)).NotTo(HaveOccurred())
+			Expect(env.Close()).NotTo(HaveOccurred())
+		})
+
+		publish := func(from int, to int) {
+			producer, err := env.NewProducer(sourceStream, nil)
+			Expect(err).NotTo(HaveOccurred())
+			var messages []message.StreamMessage
+			for i := from; i <= to; i++ {
+				messages = append(messages, amqp.NewMessage([]byte(strconv.Itoa(i))))
+			}
+			Expect(producer.BatchSend(messages)).NotTo(HaveOccurred())
+			Expect(producer.Close()).NotTo(HaveOccurred())
+		}
+
+		// consumeTarget returns the bodies of the messages copied
+		consumeTarget := func() (func() []string, *stream.Consumer) {
+			mutex := &sync.Mutex{}
+			var bodies []string
+			consumer, err := env.NewConsumer(targetStream,
+				func(consumerContext stream.ConsumerContext, message *amqp.Message) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					bodies = append(bodies, string(message.GetData()))
+				}, stream.NewConsumerOptions().SetOffset(stream.OffsetSpecification{}.First()))
+			Expect(err).NotTo(HaveOccurred())
+			return func() []string {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return append([]string(nil), bodies...)
+			}, consumer
+		}
+
+		It("Starts from Offset, then from the stored offset", func() {
+			publish(0, 9)
+			// the first run, no offset stored
+			m, err := NewMirror(env, env, NewOptions(name, sourceStream, targetStream).
+				SetOffset(stream.OffsetSpecification{}.Offset(5)).SetStoreEvery(1))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(m.Mirrored, 5*time.Second).Should(Equal(int64(5)))
+			Expect(m.Close()).NotTo(HaveOccurred())
+			Expect(m.Err()).NotTo(HaveOccurred())
+
+			publish(10, 14)
+			// Offset is ignored once the offset is stored
+			m, err = NewMirror(env, env, NewOptions(name, sourceStream, targetStream).
+				SetOffset(stream.OffsetSpecification{}.First()))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(m.Mirrored, 5*time.Second).Should(BeNumerically(">=", int64(5)))
+			Expect(m.Close()).NotTo(HaveOccurred())
+
+			bodies, consumer := consumeTarget()
+			Eventually(bodies, 5*time.Second).Should(Equal(
+				[]string{"5", "6", "7", "8", "9", "10", "11", "12", "13", "14"}))
+			Consistently(func() int { return len(bodies()) }, time.Second).Should(Equal(10))
+			Expect(consumer.Close()).NotTo(HaveOccurred())
+		})
+
+		It("The broker drops the copies published again on restart", func() {
+			publish(0, 9)
+			m, err := NewMirror(env, env, NewOptions(name, sourceStream, targetStream))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(m.Mirrored, 5*time.Second).Should(Equal(int64(10)))
+			Expect(m.Close()).NotTo(HaveOccurred())
+
+			// a crash before the store of the last offsets
+			offsetConsumer, err := env.NewConsumer(sourceStream,
+				func(consumerContext stream.ConsumerContext, message *amqp.Message) {},
+				stream.NewConsumerOptions().SetConsumerName(name).ManualCommit())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(offsetConsumer.StoreCustomOffset(4)).NotTo(HaveOccurred())
+			Expect(offsetConsumer.Close()).NotTo(HaveOccurred())
+
+			publish(10, 11)
+			m, err = NewMirror(env, env, NewOptions(name, sourceStream, targetStream))
+			Expect(err).NotTo(HaveOccurred())
+			bodies, consumer := consumeTarget()
+			Eventually(func() int { return len(bodies()) }, 5*time.Second).Should(Equal(12))
+			Consistently(func() int { return len(bodies()) }, time.Second).Should(Equal(12))
+			Expect(m.Close()).NotTo(HaveOccurred())
+			Expect(m.Err()).NotTo(HaveOccurred())
+			Expect(consumer.Close()).NotTo(HaveOccurred())
+		})
+
+		It("Filters and transforms the messages", func() {
+			publish(0, 9)
+			m, err := NewMirror(env, env, NewOptions(name, sourceStream, targetStream).
+				SetFilter(func(message *amqp.Message, messageContext stream.MessageContext) bool {
+					return messageContext.Offset%2 == 0
+				}).
+				SetTransform(func(message *amqp.Message, messageContext stream.MessageContext) *amqp.Message {
+					if messageContext.Offset == 8 {
+						// skipped too
+						return nil
+					}
+					return &amqp.Message{Data: [][]byte{[]byte("copy_" + string(message.GetData()))}}
+				}).SetStoreEvery(1))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(m.Mirrored, 5*time.Second).Should(Equal(int64(4)))
+
+			bodies, consumer := consumeTarget()
+			Eventually(bodies, 5*time.Second).Should(Equal(
+				[]string{"copy_0", "copy_2", "copy_4", "copy_6"}))
+			Expect(consumer.Close()).NotTo(HaveOccurred())
+			Expect(m.Close()).NotTo(HaveOccurred())
+			Expect(m.Err()).NotTo(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,114 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a row of the outbox table
+type Event struct {
+	// ID is the publishing ID of the message, the IDs must not be negative
+	// and must grow in the order the rows are committed
+	ID   int64
+	Body []byte
+	// ApplicationProperties are added to the message, they can be nil
+	ApplicationProperties map[string]interface{}
+}
+
+// Driver reads and updates the outbox table
+type Driver interface {
+	// Pending returns up to limit events not sent yet, ordered by ID
+	Pending(ctx context.Context, limit int) ([]Event, error)
+	// MarkSent marks the events as sent, they are not returned
+	// by Pending anymore
+	MarkSent(ctx context.Context, ids []int64) error
+}
+
+// SQLDriver is a Driver for a database/sql table with an ID column,
+// a body column and a nullable sent column, NULL until the row is sent:
+//
+//	CREATE TABLE outbox (id INTEGER PRIMARY KEY, body BLOB NOT NULL, sent_at TIMESTAMP)
+//
+// The placeholders are "?" by default, like SQLite and MySQL, see SetPlaceholder.
+type SQLDriver struct {
+	db          *sql.DB
+	Table       string
+	IdColumn    string
+	BodyColumn  string
+	SentColumn  string
+	Placeholder func(position int) string
+}
+
+func NewSQLDriver(db *sql.DB, table string) *SQLDriver {
+	return &SQLDriver{
+		db:          db,
+		Table:       table,
+		IdColumn:    "id",
+		BodyColumn:  "body",
+		SentColumn:  "sent_at",
+		Placeholder: QuestionPlaceholder,
+	}
+}
+
+func (d *SQLDriver) SetColumns(idColumn string, bodyColumn string, sentColumn string) *SQLDriver {
+	d.IdColumn = idColumn
+	d.BodyColumn = bodyColumn
+	d.SentColumn = sentColumn
+	return d
+}
+
+func (d *SQLDriver) SetPlaceholder(placeholder func(position int) string) *SQLDriver {
+	d.Placeholder = placeholder
+	return d
+}
+
+// QuestionPlaceholder is the placeholder of SQLite and MySQL
+func QuestionPlaceholder(position int) string {
+	return "?"
+}
+
+// DollarPlaceholder is the placeholder of PostgreSQL
+func DollarPlaceholder(position int) string {
+	return "$" + strconv.Itoa(position)
+}
+
+func (d *SQLDriver) Pending(ctx context.Context, limit int) ([]Event, error) {
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NULL ORDER BY %s LIMIT %d",
+		d.IdColumn, d.BodyColumn, d.Table, d.SentColumn, d.IdColumn, limit)
+	rows, err := d.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.Body); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (d *SQLDriver) MarkSent(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, time.Now().UTC())
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		placeholders[i] = d.Placeholder(i + 2)
+		args = append(args, id)
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IN (%s)",
+		d.Table, d.SentColumn, d.Placeholder(1), d.IdColumn, strings.Join(placeholders, ", "))
+	_, err := d.db.ExecContext(ctx, query, args...)
+	return err
+}
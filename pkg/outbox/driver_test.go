@@ -0,0 +1,78 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SQL driver", func() {
+	var (
+		db  *sql.DB
+		ctx context.Context
+	)
+	BeforeEach(func() {
+		var err error
+		db, err = sql.Open("sqlite3", ":memory:")
+		Expect(err).NotTo(HaveOccurred())
+		// each connection has its own in-memory database
+		db.SetMaxOpenConns(1)
+		_, err = db.Exec("CREATE TABLE outbox (id INTEGER PRIMARY KEY, body BLOB NOT NULL, sent_at TIMESTAMP)")
+		Expect(err).NotTo(HaveOccurred())
+		for _, id := range []int64{3, 1, 2, 5, 4} {
+			_, err = db.Exec("INSERT INTO outbox (id, body) VALUES (?, ?)", id, []byte{byte(id)})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		ctx = context.Background()
+	})
+	AfterEach(func() {
+		Expect(db.Close()).NotTo(HaveOccurred())
+	})
+
+	ids := func(events []Event) []int64 {
+		var result []int64
+		for _, event := range events {
+			result = append(result, event.ID)
+		}
+		return result
+	}
+
+	It("Pending returns the events by ID", func() {
+		events, err := NewSQLDriver(db, "outbox").Pending(ctx, 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(events)).To(Equal([]int64{1, 2, 3}))
+		Expect(events[1].Body).To(Equal([]byte{2}))
+	})
+
+	It("MarkSent with question placeholders", func() {
+		driver := NewSQLDriver(db, "outbox")
+		Expect(driver.MarkSent(ctx, []int64{1, 3})).NotTo(HaveOccurred())
+		Expect(driver.MarkSent(ctx, nil)).NotTo(HaveOccurred())
+		events, err := driver.Pending(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(events)).To(Equal([]int64{2, 4, 5}))
+	})
+
+	It("MarkSent with dollar placeholders", func() {
+		driver := NewSQLDriver(db, "outbox").SetPlaceholder(DollarPlaceholder)
+		Expect(driver.MarkSent(ctx, []int64{2, 4, 5})).NotTo(HaveOccurred())
+		events, err := driver.Pending(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(events)).To(Equal([]int64{1, 3}))
+	})
+
+	It("Custom columns", func() {
+		_, err := db.Exec("CREATE TABLE events (event_id INTEGER PRIMARY KEY, payload BLOB, published TIMESTAMP)")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = db.Exec("INSERT INTO events (event_id, payload) VALUES (7, 'a'), (8, 'b')")
+		Expect(err).NotTo(HaveOccurred())
+		driver := NewSQLDriver(db, "events").SetColumns("event_id", "payload", "published")
+		Expect(driver.MarkSent(ctx, []int64{7})).NotTo(HaveOccurred())
+		events, err := driver.Pending(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(events)).To(Equal([]int64{8}))
+	})
+})
@@ -0,0 +1,338 @@
+// Package outbox publishes the events that an application writes to a
+// database table, in the same transaction of its changes, to a stream.
+//
+// The row ID is the publishing ID of the message and the producer has
+// the outbox name, so the broker drops the events published again after
+// a crash and each event is stored once. The rows are marked as sent
+// once the messages are confirmed.
+//
+// The broker drops any publishing ID lower than the last one stored,
+// so the IDs must grow in the order the rows are committed: with
+// concurrent transactions a row committed after a row with a higher ID
+// would be lost. Write the outbox from one transaction at a time or
+// assign the IDs at commit time.
+//
+// For the same reason an event that is not confirmed is not published
+// again: the outbox stops and Err returns the event ID. The row is still
+// pending, it needs a new ID before the next run.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+)
+
+const (
+	defaultPollInterval   = time.Second
+	defaultBatchSize      = 100
+	defaultConfirmTimeout = 10 * time.Second
+)
+
+type Options struct {
+	// Name is the producer name, it is mandatory and must not change
+	// between the runs, the deduplication works per name
+	Name   string
+	Stream string
+	// PollInterval is the pause between two reads when the table has
+	// no pending events, see Outbox.Trigger
+	PollInterval time.Duration
+	// BatchSize is the number of events read at a time
+	BatchSize int
+	// ConfirmTimeout is how long a batch waits for the confirmations
+	// before reading the next events
+	ConfirmTimeout time.Duration
+}
+
+func NewOptions(name string, streamName string) *Options {
+	return &Options{
+		Name:           name,
+		Stream:         streamName,
+		PollInterval:   defaultPollInterval,
+		BatchSize:      defaultBatchSize,
+		ConfirmTimeout: defaultConfirmTimeout,
+	}
+}
+
+func (o *Options) SetPollInterval(pollInterval time.Duration) *Options {
+	o.PollInterval = pollInterval
+	return o
+}
+
+func (o *Options) SetBatchSize(batchSize int) *Options {
+	o.BatchSize = batchSize
+	return o
+}
+
+func (o *Options) SetConfirmTimeout(confirmTimeout time.Duration) *Options {
+	o.ConfirmTimeout = confirmTimeout
+	return o
+}
+
+func (o *Options) validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("the outbox needs a Name")
+	}
+	if o.Stream == "" {
+		return fmt.Errorf("the outbox needs a Stream")
+	}
+	if o.PollInterval <= 0 {
+		return fmt.Errorf("PollInterval must be positive")
+	}
+	if o.BatchSize <= 0 {
+		return fmt.Errorf("BatchSize must be positive")
+	}
+	if o.ConfirmTimeout <= 0 {
+		return fmt.Errorf("ConfirmTimeout must be positive")
+	}
+	return nil
+}
+
+type Outbox struct {
+	options  *Options
+	driver   Driver
+	producer *stream.Producer
+
+	mutex *sync.Mutex
+	// the IDs published and not yet confirmed
+	inFlight map[int64]bool
+	// the IDs confirmed and not yet marked as sent
+	confirmed []int64
+	// signaled by the confirmations
+	settled chan struct{}
+	trigger chan struct{}
+
+	published int64
+	err       error
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewOutbox starts to publish the pending events of the driver
+// to options.Stream, until Close
+func NewOutbox(env *stream.Environment, driver Driver, options *Options) (*Outbox, error) {
+	if driver == nil {
+		return nil, fmt.Errorf("the outbox needs a driver")
+	}
+	if options == nil {
+		return nil, fmt.Errorf("the outbox needs the options")
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	producer, err := env.NewProducer(options.Stream,
+		stream.NewProducerOptions().SetProducerName(options.Name))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		options:   options,
+		driver:    driver,
+		producer:  producer,
+		mutex:     &sync.Mutex{},
+		inFlight:  map[int64]bool{},
+		settled:   make(chan struct{}, 1),
+		trigger:   make(chan struct{}, 1),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go o.handleConfirms(producer.NotifyPublishConfirmation())
+	go o.run(ctx)
+	return o, nil
+}
+
+// Trigger reads the table now, without waiting for PollInterval,
+// call it after the commit of new events
+func (o *Outbox) Trigger() {
+	select {
+	case o.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Published is the number of events confirmed
+func (o *Outbox) Published() int64 {
+	return atomic.LoadInt64(&o.published)
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	defer close(o.done)
+	for {
+		read, err := o.publishPending(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logs.LogWarn("outbox %s: %s", o.options.Name, err)
+		}
+		if err == nil && read == o.options.BatchSize {
+			// more events are waiting
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.trigger:
+		case <-time.After(o.options.PollInterval):
+		}
+	}
+}
+
+// publishPending publishes a batch of events and marks the confirmed
+// ones as sent, it returns the number of events read
+func (o *Outbox) publishPending(ctx context.Context) (int, error) {
+	events, err := o.driver.Pending(ctx, o.options.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, event := range events {
+		if event.ID < 0 {
+			return len(events), fmt.Errorf("event %d: the ID can't be negative", event.ID)
+		}
+		if !o.addInFlight(event.ID) {
+			// still waiting for the confirmation of a previous batch
+			continue
+		}
+		message := amqp.NewMessage(event.Body)
+		message.SetPublishingId(event.ID)
+		if event.ApplicationProperties != nil {
+			message.SetApplicationProperties(event.ApplicationProperties)
+		}
+		if err := o.producer.SendWithContext(ctx, message); err != nil {
+			o.removeInFlight(event.ID)
+			return len(events), err
+		}
+	}
+
+	if !o.waitConfirmed(ctx) && ctx.Err() == nil {
+		logs.LogWarn("outbox %s: events not confirmed in %s",
+			o.options.Name, o.options.ConfirmTimeout)
+	}
+	return len(events), o.markSent(ctx)
+}
+
+func (o *Outbox) handleConfirms(confirms stream.ChannelPublishConfirm) {
+	for messages := range confirms {
+		var failed error
+		o.mutex.Lock()
+		for _, message := range messages {
+			delete(o.inFlight, message.SequenceID)
+			if message.Confirmed {
+				o.confirmed = append(o.confirmed, message.SequenceID)
+			} else if o.err == nil {
+				// the events after it can be stored already, the broker
+				// would drop it as a duplicate
+				err := message.Err
+				if err == nil {
+					err = fmt.Errorf("not confirmed")
+				}
+				o.err = fmt.Errorf("event %d: %w", message.SequenceID, err)
+				failed = o.err
+			}
+		}
+		o.mutex.Unlock()
+		if failed != nil {
+			logs.LogWarn("outbox %s stopped: %s", o.options.Name, failed)
+			o.cancel()
+		}
+		select {
+		case o.settled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitConfirmed waits until all the events published are confirmed,
+// or not, up to ConfirmTimeout
+func (o *Outbox) waitConfirmed(ctx context.Context) bool {
+	timeout := time.NewTimer(o.options.ConfirmTimeout)
+	defer timeout.Stop()
+	for {
+		o.mutex.Lock()
+		inFlight := len(o.inFlight)
+		o.mutex.Unlock()
+		if inFlight == 0 {
+			return true
+		}
+		select {
+		case <-o.settled:
+		case <-timeout.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (o *Outbox) markSent(ctx context.Context) error {
+	o.mutex.Lock()
+	ids := o.confirmed
+	o.confirmed = nil
+	o.mutex.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	// the events not marked are published again and dropped by the broker
+	if err := o.driver.MarkSent(ctx, ids); err != nil {
+		return err
+	}
+	atomic.AddInt64(&o.published, int64(len(ids)))
+	return nil
+}
+
+func (o *Outbox) addInFlight(id int64) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.inFlight[id] {
+		return false
+	}
+	o.inFlight[id] = true
+	return true
+}
+
+func (o *Outbox) removeInFlight(id int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.inFlight, id)
+}
+
+// Done is closed when the outbox stops, by Close or by an error
+func (o *Outbox) Done() <-chan struct{} {
+	return o.done
+}
+
+// Err is the error that stopped the outbox, nil after Close
+func (o *Outbox) Err() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.err
+}
+
+// Close stops the outbox, the events not marked as sent are
+// published again by the next outbox with the same name
+func (o *Outbox) Close() error {
+	var err error
+	o.closeOnce.Do(func() {
+		o.cancel()
+		<-o.done
+		// the confirmations received in the meantime
+		if errMark := o.markSent(context.Background()); errMark != nil {
+			logs.LogWarn("outbox %s: %s", o.options.Name, errMark)
+		}
+		err = o.producer.Close()
+		if err == stream.AlreadyClosed {
+			err = nil
+		}
+	})
+	return err
+}
@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+)
+
+// fakeDriver keeps the events in memory
+type fakeDriver struct {
+	mutex  *sync.Mutex
+	events map[int64]Event
+	sent   map[int64]bool
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{mutex: &sync.Mutex{}, events: map[int64]Event{}, sent: map[int64]bool{}}
+}
+
+func (f *fakeDriver) add(from int64, to int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for id := from; id <= to; id++ {
+		f.events[id] = Event{ID: id, Body: []byte("event_" + strconv.FormatInt(id, 10))}
+	}
+}
+
+// unmark is a crash after the publish and before the update of the table
+func (f *fakeDriver) unmark() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.sent = map[int64]bool{}
+}
+
+func (f *fakeDriver) sentCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.sent)
+}
+
+func (f *fakeDriver) Pending(ctx context.Context, limit int) ([]Event, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var events []Event
+	for id, event := range f.events {
+		if !f.sent[id] {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (f *fakeDriver) MarkSent(ctx context.Context, ids []int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range ids {
+		f.sent[id] = true
+	}
+	return nil
+}
+
+var _ = Describe("Outbox", func() {
+	var (
+		env        *stream.Environment
+		streamName string
+		driver     *fakeDriver
+		name       string
+	)
+	BeforeEach(func() {
+		var err error
+		env, err = stream.NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		streamName = uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+		driver = newFakeDriver()
+		name = uuid.New().String()
+	})
+	AfterEach(func() {
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+	})
+
+	// countMessages consumes the stream from the start
+	countMessages := func() (func() int32, *stream.Consumer) {
+		var count int32
+		consumer, err := env.NewConsumer(streamName,
+			func(consumerContext stream.ConsumerContext, message *amqp.Message) {
+				atomic.AddInt32(&count, 1)
+			}, stream.NewConsumerOptions().SetOffset(stream.OffsetSpecification{}.First()))
+		Expect(err).NotTo(HaveOccurred())
+		return func() int32 {
+			return atomic.LoadInt32(&count)
+		}, consumer
+	}
+
+	It("Validates the options", func() {
+		_, err := NewOutbox(env, driver, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = NewOutbox(env, nil, NewOptions(name, streamName))
+		Expect(err).To(HaveOccurred())
+		_, err = NewOutbox(env, driver, NewOptions("", streamName))
+		Expect(err).To(HaveOccurred())
+		_, err = NewOutbox(env, driver, NewOptions(name, streamName).SetBatchSize(0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Publishes and marks the pending events", func() {
+		driver.add(0, 249)
+		outbox, err := NewOutbox(env, driver, NewOptions(name, streamName).SetBatchSize(100))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(driver.sentCount, 5*time.Second).Should(Equal(250))
+		Eventually(outbox.Published, 5*time.Second).Should(Equal(int64(250)))
+		Expect(outbox.Close()).NotTo(HaveOccurred())
+		Expect(outbox.Err()).NotTo(HaveOccurred())
+		count, consumer := countMessages()
+		Eventually(count, 5*time.Second).Should(Equal(int32(250)))
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+	})
+
+	It("Trigger reads the new events", func() {
+		outbox, err := NewOutbox(env, driver, NewOptions(name, streamName).SetPollInterval(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		driver.add(0, 9)
+		outbox.Trigger()
+		Eventually(driver.sentCount, 5*time.Second).Should(Equal(10))
+		Expect(outbox.Close()).NotTo(HaveOccurred())
+	})
+
+	It("The broker drops the events published again", func() {
+		driver.add(0, 19)
+		outbox, err := NewOutbox(env, driver, NewOptions(name, streamName))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(driver.sentCount, 5*time.Second).Should(Equal(20))
+		Expect(outbox.Close()).NotTo(HaveOccurred())
+
+		driver.unmark()
+		driver.add(20, 24)
+		outbox, err = NewOutbox(env, driver, NewOptions(name, streamName))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(driver.sentCount, 5*time.Second).Should(Equal(25))
+		Expect(outbox.Close()).NotTo(HaveOccurred())
+		Expect(outbox.Err()).NotTo(HaveOccurred())
+
+		count, consumer := countMessages()
+		Eventually(count, 5*time.Second).Should(Equal(int32(25)))
+		Consistently(count, time.Second).Should(Equal(int32(25)))
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+	})
+})
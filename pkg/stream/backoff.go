@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffPolicy decides if and when a failed connection is attempted again.
+// attempt is the number of failed attempts so far, starting from 1,
+// elapsed the time since the first attempt.
+// It returns false when the retry budget is exhausted.
+type BackoffPolicy interface {
+	NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after each
+// attempt, up to MaxDelay. Jitter, between 0 and 1, randomizes each delay
+// by that fraction, so the clients don't reconnect all together.
+// Zero MaxAttempts or MaxElapsedTime means no limit.
+type ExponentialBackoff struct {
+	InitialDelay   time.Duration
+	MaxDelay       time.Duration
+	Multiplier     float64
+	Jitter         float64
+	MaxAttempts    int
+	MaxElapsedTime time.Duration
+}
+
+func NewExponentialBackoff() *ExponentialBackoff {
+	return &ExponentialBackoff{
+		InitialDelay:   defaultBackoffInitialDelay,
+		MaxDelay:       defaultBackoffMaxDelay,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxElapsedTime: defaultBackoffMaxElapsedTime,
+	}
+}
+
+func (b *ExponentialBackoff) SetInitialDelay(initialDelay time.Duration) *ExponentialBackoff {
+	b.InitialDelay = initialDelay
+	return b
+}
+
+func (b *ExponentialBackoff) SetMaxDelay(maxDelay time.Duration) *ExponentialBackoff {
+	b.MaxDelay = maxDelay
+	return b
+}
+
+func (b *ExponentialBackoff) SetMultiplier(multiplier float64) *ExponentialBackoff {
+	b.Multiplier = multiplier
+	return b
+}
+
+func (b *ExponentialBackoff) SetJitter(jitter float64) *ExponentialBackoff {
+	b.Jitter = jitter
+	return b
+}
+
+func (b *ExponentialBackoff) SetMaxAttempts(maxAttempts int) *ExponentialBackoff {
+	b.MaxAttempts = maxAttempts
+	return b
+}
+
+func (b *ExponentialBackoff) SetMaxElapsedTime(maxElapsedTime time.Duration) *ExponentialBackoff {
+	b.MaxElapsedTime = maxElapsedTime
+	return b
+}
+
+func (b *ExponentialBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	if b.MaxElapsedTime > 0 && elapsed >= b.MaxElapsedTime {
+		return 0, false
+	}
+
+	delay := float64(b.InitialDelay) * math.Pow(b.Multiplier, float64(attempt-1))
+	if b.MaxDelay > 0 && delay > float64(b.MaxDelay) {
+		delay = float64(b.MaxDelay)
+	}
+	if b.Jitter > 0 {
+		delay = delay * (1 - b.Jitter + 2*b.Jitter*randomFloat())
+	}
+	return time.Duration(delay), true
+}
+
+// random is shared by the client, rand.Rand is not safe for concurrent use
+var random = struct {
+	*sync.Mutex
+	*rand.Rand
+}{&sync.Mutex{}, rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func randomFloat() float64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.Float64()
+}
+
+func randomIntn(n int) int {
+	random.Lock()
+	defer random.Unlock()
+	return random.Intn(n)
+}
@@ -0,0 +1,50 @@
+package stream
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backoff policy", func() {
+
+	It("Exponential delays without jitter", func() {
+		backoff := NewExponentialBackoff().SetJitter(0).
+			SetInitialDelay(100 * time.Millisecond).
+			SetMaxDelay(time.Second).SetMaxElapsedTime(0)
+		expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond,
+			400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+		for i, e := range expected {
+			delay, retry := backoff.NextDelay(i+1, 0)
+			Expect(retry).To(BeTrue())
+			Expect(delay).To(Equal(e))
+		}
+	})
+
+	It("Jitter keeps the delay in range", func() {
+		backoff := NewExponentialBackoff().SetJitter(0.5).
+			SetInitialDelay(time.Second)
+		for i := 0; i < 100; i++ {
+			delay, retry := backoff.NextDelay(1, 0)
+			Expect(retry).To(BeTrue())
+			Expect(delay).To(BeNumerically(">=", 500*time.Millisecond))
+			Expect(delay).To(BeNumerically("<=", 1500*time.Millisecond))
+		}
+	})
+
+	It("Stops when the budget is exhausted", func() {
+		backoff := NewExponentialBackoff().SetMaxAttempts(3).SetMaxElapsedTime(0)
+		_, retry := backoff.NextDelay(2, time.Hour)
+		Expect(retry).To(BeTrue())
+		_, retry = backoff.NextDelay(3, 0)
+		Expect(retry).To(BeFalse())
+
+		backoff = NewExponentialBackoff().SetMaxElapsedTime(time.Second)
+		_, retry = backoff.NextDelay(100, 500*time.Millisecond)
+		Expect(retry).To(BeTrue())
+		_, retry = backoff.NextDelay(1, time.Second)
+		Expect(retry).To(BeFalse())
+	})
+
+})
@@ -17,6 +17,10 @@ type Broker struct {
 	Password  string
 	Scheme    string
 	tlsConfig *tls.Config
+	// set when Host and Port come from an AddressResolver,
+	// the connection must land on the advertised node
+	advertisedHost string
+	advertisedPort string
 }
 
 func newBrokerDefault() *Broker {
@@ -114,6 +118,35 @@ func (brs *Brokers) Get(brokerReference int16) *Broker {
 	return value.(*Broker)
 }
 
+// Address is a host and port pair
+type Address struct {
+	Host string
+	Port string
+}
+
+// AddressResolver maps the address advertised by a node, as returned by the
+// stream metadata, to an address the client can dial, for example
+// a load balancer or a Kubernetes service
+type AddressResolver func(advertised Address) Address
+
+// resolveWith replaces Host and Port with the resolved address and
+// keeps the advertised ones, to check the node the connection lands on
+func (br *Broker) resolveWith(resolver AddressResolver) {
+	if resolver == nil {
+		return
+	}
+	resolved := resolver(Address{Host: br.Host, Port: br.Port})
+	br.advertisedHost = br.Host
+	br.advertisedPort = br.Port
+	br.Host = resolved.Host
+	br.Port = resolved.Port
+	br.Uri = ""
+}
+
+func (br *Broker) isResolved() bool {
+	return br.advertisedHost != ""
+}
+
 func (br *Broker) hostPort() string {
 	return fmt.Sprintf("%s:%s", br.Host, br.Port)
 }
@@ -131,6 +164,16 @@ func (StreamMetadata) New(stream string, responseCode uint16,
 		Leader: leader, replicas: replicas}
 }
 
+// Replicas are the nodes of the stream replicas, the leader excluded
+func (s *StreamMetadata) Replicas() []*Broker {
+	return s.replicas
+}
+
+// brokers are the leader and the replicas
+func (s *StreamMetadata) brokers() []*Broker {
+	return append([]*Broker{s.Leader}, s.replicas...)
+}
+
 type StreamsMetadata struct {
 	items *sync.Map
 }
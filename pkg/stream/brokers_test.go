@@ -0,0 +1,28 @@
+package stream
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Brokers", func() {
+
+	It("Resolve the advertised address", func() {
+		broker := newBroker("node-1.internal", "5552")
+		broker.cloneFrom(newBrokerDefault())
+		Expect(broker.isResolved()).To(BeFalse())
+		broker.resolveWith(nil)
+		Expect(broker.isResolved()).To(BeFalse())
+
+		broker.resolveWith(func(advertised Address) Address {
+			Expect(advertised).To(Equal(Address{Host: "node-1.internal", Port: "5552"}))
+			return Address{Host: "lb.example.com", Port: "15552"}
+		})
+		Expect(broker.isResolved()).To(BeTrue())
+		Expect(broker.hostPort()).To(Equal("lb.example.com:15552"))
+		Expect(broker.advertisedHost).To(Equal("node-1.internal"))
+		Expect(broker.advertisedPort).To(Equal("5552"))
+		Expect(broker.GetUri()).To(ContainSubstring("@lb.example.com:15552/"))
+	})
+
+})
@@ -45,6 +45,15 @@ func writeString(inputBuff *bytes.Buffer, value string) {
 	inputBuff.Write([]byte(value))
 }
 
+// writeNullableString writes the empty string as null
+func writeNullableString(inputBuff *bytes.Buffer, value string) {
+	if value == "" {
+		writeShort(inputBuff, -1)
+		return
+	}
+	writeString(inputBuff, value)
+}
+
 func writeBytes(inputBuff *bytes.Buffer, value []byte) {
 	inputBuff.Write(value)
 }
@@ -54,9 +63,17 @@ func writeProtocolHeader(inputBuff *bytes.Buffer,
 	length int, command int16,
 	correlationId ...int) {
 
+	writeVersionedProtocolHeader(inputBuff, length, command, version1, correlationId...)
+
+}
+
+func writeVersionedProtocolHeader(inputBuff *bytes.Buffer,
+	length int, command int16, version int16,
+	correlationId ...int) {
+
 	writeInt(inputBuff, length)
 	writeShort(inputBuff, command)
-	writeShort(inputBuff, version1)
+	writeShort(inputBuff, version)
 	if len(correlationId) > 0 {
 		writeInt(inputBuff, correlationId[0])
 	}
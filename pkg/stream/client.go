@@ -6,7 +6,6 @@ import (
 	"crypto/tls"
 	"fmt"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
-	"math/rand"
 	"net"
 	"net/url"
 	"sync"
@@ -27,14 +26,32 @@ type Client struct {
 	socket           socket
 	destructor       *sync.Once
 	clientProperties ClientProperties
-	tuneState        TuneState
-	coordinator      *Coordinator
-	broker           *Broker
-	plainCRCBuffer   []byte
+	// clientTuneState is what the client asks for,
+	// tuneState what is negotiated with the server
+	clientTuneState TuneState
+	tuneState       TuneState
+	coordinator     *Coordinator
+	broker          *Broker
+	plainCRCBuffer  []byte
 
 	mutex            *sync.Mutex
 	metadataListener metadataListener
 	lastHeartBeat    time.Time
+	serverProperties map[string]string
+	// the properties returned by open, like the advertised host and port
+	connectionProperties map[string]string
+	// the command versions negotiated with the server
+	commandVersions map[uint16]uint16
+	// nil when the lifecycle events are disabled
+	events *eventBus
+	// 1 after the connection opened event, see closeWithReason
+	opened int32
+	// true when the connection is used by a single producer,
+	// see NewDedicatedStrategy
+	dedicated bool
+	// true while the producers move out of the connection, it is not
+	// chosen for new producers, see rebalanceConnection
+	emptying bool
 }
 
 func newClient(connectionName string, broker *Broker) *Client {
@@ -51,6 +68,10 @@ func newClient(connectionName string, broker *Broker) *Client {
 		clientProperties: ClientProperties{items: make(map[string]string)},
 		plainCRCBuffer:   make([]byte, 4096),
 		lastHeartBeat:    time.Now(),
+		clientTuneState: TuneState{
+			requestedMaxFrameSize: defaultRequestedMaxFrameSize,
+			requestedHeartbeat:    int(defaultRequestedHeartbeat / time.Second),
+		},
 	}
 	c.setConnectionName(connectionName)
 	return c
@@ -79,6 +100,17 @@ func (c *Client) getTuneState() TuneState {
 	return c.tuneState
 }
 
+// ServerInfo returns the server peer properties and the connection
+// properties, nil when the client is not connected
+func (c *Client) ServerInfo() *ServerInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.serverProperties == nil {
+		return nil
+	}
+	return newServerInfo(c.serverProperties, c.connectionProperties)
+}
+
 func (c *Client) getLastHeartBeat() time.Time {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -100,8 +132,7 @@ func (c *Client) connect() error {
 			return err
 		}
 		host, port := u.Hostname(), u.Port()
-		c.tuneState.requestedHeartbeat = 60
-		c.tuneState.requestedMaxFrameSize = 1048576
+		c.tuneState = c.clientTuneState
 
 		var dialer = &net.Dialer{
 			Control: controlFunc,
@@ -165,7 +196,25 @@ func (c *Client) connect() error {
 			logs.LogDebug("%s", err2)
 			return err2
 		}
+		if c.broker.isResolved() &&
+			(c.connectionProperties["advertised_host"] != c.broker.advertisedHost ||
+				c.connectionProperties["advertised_port"] != c.broker.advertisedPort) {
+			logs.LogDebug("connected to %s:%s, expected %s:%s",
+				c.connectionProperties["advertised_host"], c.connectionProperties["advertised_port"],
+				c.broker.advertisedHost, c.broker.advertisedPort)
+			c.socket.shutdown(nil)
+			return AdvertisedAddressMismatch
+		}
+		if serverSupportsExchangeVersion(c.serverProperties["version"]) {
+			err2 = c.exchangeCommandVersions()
+			if err2 != nil {
+				logs.LogDebug("%s", err2)
+				return err2
+			}
+		}
 		c.heartBeat()
+		atomic.StoreInt32(&c.opened, 1)
+		c.emit(LifecycleEvent{Type: EventConnectionOpened})
 		logs.LogDebug("User %s, connected to: %s, vhost:%s", u.User.Username(),
 			net.JoinHostPort(host, port),
 			vhost)
@@ -177,6 +226,17 @@ func (c *Client) setConnectionName(connectionName string) {
 	c.clientProperties.items["connection_name"] = connectionName
 }
 
+// setClientProperties adds custom properties, the connection name
+// and the properties set by peerProperties can't be replaced
+func (c *Client) setClientProperties(properties map[string]string) {
+	for key, value := range properties {
+		if key == "connection_name" {
+			continue
+		}
+		c.clientProperties.items[key] = value
+	}
+}
+
 func (c *Client) peerProperties() error {
 	clientPropertiesSize := 4 // size of the map, always there
 
@@ -202,7 +262,20 @@ func (c *Client) peerProperties() error {
 		writeString(b, element)
 	}
 
-	return c.handleWrite(b.Bytes(), resp).Err
+	err := c.handleWriteWithResponse(b.Bytes(), resp, false)
+	if err.Err != nil {
+		if !err.isTimeout {
+			// the data follows the code also in case of error
+			<-resp.data
+		}
+		_ = c.coordinator.RemoveResponseById(resp.correlationid)
+		return err.Err
+	}
+
+	serverProperties := <-resp.data
+	c.serverProperties = serverProperties.(map[string]string)
+	_ = c.coordinator.RemoveResponseById(resp.correlationid)
+	return nil
 }
 
 func (c *Client) authenticate(user string, password string) error {
@@ -265,8 +338,35 @@ func (c *Client) sendSaslAuthenticate(saslMechanism string, challengeResponse []
 	if errR != nil {
 		return errR
 	}
+	// called during connect, the client mutex is already locked
+	c.tuneState = tuneData.(TuneState)
+	return c.sendTune(c.tuneState)
+}
 
-	return c.socket.writeAndFlush(tuneData.([]byte))
+func (c *Client) sendTune(tuneState TuneState) error {
+	length := 2 + 2 + 4 + 4
+	var b = bytes.NewBuffer(make([]byte, 0, length+4))
+	writeInt(b, length)
+	writeUShort(b, uShortEncodeResponseCode(commandTune))
+	writeShort(b, version1)
+	writeInt(b, tuneState.requestedMaxFrameSize)
+	writeInt(b, tuneState.requestedHeartbeat)
+	return c.socket.writeAndFlush(b.Bytes())
+}
+
+// negotiateTuneValue is the lower of the two values,
+// zero means no limit
+func negotiateTuneValue(clientValue int, serverValue int) int {
+	if clientValue == 0 || serverValue == 0 {
+		if clientValue > serverValue {
+			return clientValue
+		}
+		return serverValue
+	}
+	if clientValue < serverValue {
+		return clientValue
+	}
+	return serverValue
 }
 
 func (c *Client) open(virtualHost string) error {
@@ -283,9 +383,7 @@ func (c *Client) open(virtualHost string) error {
 	}
 
 	advHostPort := <-resp.data
-	for k, v := range advHostPort.(ClientProperties).items {
-		c.clientProperties.items[k] = v
-	}
+	c.connectionProperties = advHostPort.(ClientProperties).items
 	_ = c.coordinator.RemoveResponseById(resp.correlationid)
 	return nil
 
@@ -305,19 +403,25 @@ func (c *Client) DeleteStream(streamName string) error {
 }
 
 func (c *Client) heartBeat() {
-	ticker := time.NewTicker(60 * time.Second)
-	tickerHeatBeat := time.NewTicker(20 * time.Second)
+	if c.tuneState.requestedHeartbeat <= 0 {
+		// heartbeat disabled by the negotiation
+		return
+	}
+	heartbeat := time.Duration(c.tuneState.requestedHeartbeat) * time.Second
+	ticker := time.NewTicker(heartbeat)
+	tickerHeatBeat := time.NewTicker(heartbeat / 3)
 	resp := c.coordinator.NewResponseWitName("heartbeat")
 	var heartBeatMissed int32
 	go func() {
 		for c.socket.isOpen() {
 			<-tickerHeatBeat.C
-			if time.Since(c.getLastHeartBeat()) > time.Duration(c.tuneState.requestedHeartbeat)*time.Second {
+			if time.Since(c.getLastHeartBeat()) > heartbeat {
 				v := atomic.AddInt32(&heartBeatMissed, 1)
 				logs.LogWarn("Missing heart beat: %d", v)
+				c.emit(LifecycleEvent{Type: EventHeartbeatMissed, Attempt: int(v)})
 				if v >= 2 {
 					logs.LogWarn("Too many heartbeat missing: %d", v)
-					c.Close()
+					_ = c.closeWithReason("too many heartbeats missed", nil)
 				}
 			} else {
 				atomic.StoreInt32(&heartBeatMissed, 0)
@@ -354,6 +458,9 @@ func (c *Client) sendHeartbeat() {
 
 func (c *Client) closeHartBeat() {
 	c.destructor.Do(func() {
+		if c.tuneState.requestedHeartbeat <= 0 {
+			return
+		}
 		r, err := c.coordinator.GetResponseByName("heartbeat")
 		if err != nil {
 			logs.LogWarn("error removing heartbeat: %s", err)
@@ -365,6 +472,15 @@ func (c *Client) closeHartBeat() {
 }
 
 func (c *Client) Close() error {
+	return c.closeWithReason("client closed", nil)
+}
+
+// closeWithReason closes the connection, the reason and
+// the error are reported by the connection closed event
+func (c *Client) closeWithReason(reason string, closeErr error) error {
+	if atomic.CompareAndSwapInt32(&c.opened, 1, 0) {
+		defer c.emit(LifecycleEvent{Type: EventConnectionClosed, Reason: reason, Err: closeErr})
+	}
 
 	for _, p := range c.coordinator.Producers() {
 		err := c.coordinator.RemoveProducerById(p.(*Producer).ID, Event{
@@ -427,7 +543,7 @@ func (c *Client) ReusePublisher(streamName string, existingProducer *Producer) (
 	existingProducer.options.client = c
 	_, err := c.coordinator.GetProducerById(existingProducer.ID)
 	if err != nil {
-		c.coordinator.producers[existingProducer.ID] = existingProducer
+		c.coordinator.reuseProducerId(existingProducer)
 	} else {
 		return nil, fmt.Errorf("can't reuse producer")
 	}
@@ -451,12 +567,37 @@ func (c *Client) DeclarePublisher(streamName string, options *ProducerOptions) (
 			minBatchSize, maxBatchSize)
 	}
 
+	if options.Linger < 0 {
+		return nil, fmt.Errorf("Linger can't be negative")
+	}
+
+	if options.MaxBatchBytes < 0 {
+		return nil, fmt.Errorf("MaxBatchBytes can't be negative")
+	}
+
+	if options.MaxInFlight < 0 {
+		return nil, fmt.Errorf("MaxInFlight can't be negative")
+	}
+
+	if options.ConfirmTimeout != 0 && options.ConfirmTimeout < minConfirmTimeout {
+		return nil, fmt.Errorf("ConfirmTimeout must be 0 or at least %s", minConfirmTimeout)
+	}
+
+	if options.isFilterEnabled() && !c.SupportsFeature(FeatureBrokerFilter) {
+		return nil, fmt.Errorf("FilterValue needs a server with the broker side filtering")
+	}
+
 	producer, err := c.coordinator.NewProducer(&ProducerOptions{
-		client:     c,
-		streamName: streamName,
-		Name:       options.Name,
-		QueueSize:  options.QueueSize,
-		BatchSize:  options.BatchSize,
+		client:         c,
+		streamName:     streamName,
+		Name:           options.Name,
+		QueueSize:      options.QueueSize,
+		BatchSize:      options.BatchSize,
+		Linger:         options.Linger,
+		MaxBatchBytes:  options.MaxBatchBytes,
+		MaxInFlight:    options.MaxInFlight,
+		ConfirmTimeout: options.ConfirmTimeout,
+		FilterValue:    options.FilterValue,
 	})
 
 	if err != nil {
@@ -465,6 +606,8 @@ func (c *Client) DeclarePublisher(streamName string, options *ProducerOptions) (
 	res := c.internalDeclarePublisher(streamName, producer)
 	if res.Err == nil {
 		producer.startPublishTask()
+		producer.startConfirmTimeoutTask()
+		c.emit(LifecycleEvent{Type: EventProducerAdded, StreamName: streamName, Name: options.Name})
 	}
 	return producer, res.Err
 }
@@ -554,7 +697,7 @@ func (c *Client) BrokerLeader(stream string) (*Broker, error) {
 
 	streamMetadata := streamsMetadata.Get(stream)
 	if streamMetadata.responseCode != responseCodeOk {
-		return nil, lookErrorCode(streamMetadata.responseCode)
+		return nil, newStreamError(streamMetadata.responseCode, commandMetadata, stream)
 	}
 	if streamMetadata.Leader == nil {
 		return nil, fmt.Errorf("leader error for stream for stream: %s", stream)
@@ -573,21 +716,17 @@ func (c *Client) StreamExists(stream string) bool {
 	return streamMetadata.responseCode == responseCodeOk
 }
 func (c *Client) BrokerForConsumer(stream string) (*Broker, error) {
+	return c.brokerForConsumer(stream, PlacementRandom, nil)
+}
+
+// brokerForConsumer chooses the node of the consumer with the policy
+func (c *Client) brokerForConsumer(stream string, policy ConsumerPlacementPolicy,
+	connections func(broker *Broker) int) (*Broker, error) {
 	streamsMetadata := c.metaData(stream)
-	if streamsMetadata == nil {
+	if streamsMetadata == nil || streamsMetadata.Get(stream) == nil {
 		return nil, fmt.Errorf("leader error for stream for stream: %s", stream)
 	}
-
-	streamMetadata := streamsMetadata.Get(stream)
-	if streamMetadata.responseCode != responseCodeOk {
-		return nil, lookErrorCode(streamMetadata.responseCode)
-	}
-	var brokers []*Broker
-	brokers = append(brokers, streamMetadata.Leader)
-	brokers = append(brokers, streamMetadata.replicas...)
-	rand.Seed(time.Now().UnixNano())
-	n := rand.Intn(len(brokers))
-	return brokers[n], nil
+	return placeConsumer(policy, streamsMetadata.Get(stream), connections)
 }
 
 func (c *Client) DeclareStream(streamName string, options *StreamOptions) error {
@@ -625,6 +764,37 @@ func (c *Client) DeclareStream(streamName string, options *StreamOptions) error
 
 }
 
+// streamOptionsMismatch compares the options set with the metadata of
+// the existing stream: the leader and the replicas give the cluster size
+func (c *Client) streamOptionsMismatch(streamName string, options *StreamOptions) error {
+	args, err := options.setArguments()
+	if err != nil {
+		return err
+	}
+	res := &StreamOptionsMismatch{Stream: streamName}
+
+	if options.InitialClusterSize > 0 {
+		delete(args, streamArgumentInitialClusterSize)
+		var streamMetadata *StreamMetadata
+		if streamsMetadata := c.metaData(streamName); streamsMetadata != nil {
+			streamMetadata = streamsMetadata.Get(streamName)
+		}
+		if streamMetadata == nil || streamMetadata.responseCode != responseCodeOk ||
+			streamMetadata.Leader == nil {
+			res.Unverified = append(res.Unverified, "InitialClusterSize")
+		} else if clusterSize := len(streamMetadata.replicas) + 1; clusterSize != options.InitialClusterSize {
+			res.Fields = append(res.Fields, StreamOptionsDiff{
+				Field:   "InitialClusterSize",
+				Desired: fmt.Sprintf("%d", options.InitialClusterSize),
+				Actual:  fmt.Sprintf("%d", clusterSize),
+			})
+		}
+	}
+
+	res.Unverified = append(res.Unverified, options.fieldNames(args)...)
+	return res
+}
+
 func (c *Client) DeclareSubscriber(streamName string,
 	messagesHandler MessagesHandler,
 	options *ConsumerOptions) (*Consumer, error) {
@@ -632,19 +802,55 @@ func (c *Client) DeclareSubscriber(streamName string,
 		options = NewConsumerOptions()
 	}
 
-	if options.Offset.typeOfs <= 0 || options.Offset.typeOfs > 6 {
+	if options.Offset.typeOfs <= 0 || options.Offset.typeOfs > typeLastN {
 		return nil, fmt.Errorf("specify a valid Offset")
 	}
 
+	if options.Until.typeOfs != 0 && options.Until.typeOfs != typeOffset &&
+		options.Until.typeOfs != typeTimestamp {
+		return nil, fmt.Errorf("Until must be an Offset or a Timestamp")
+	}
+
+	if options.StreamFilter != nil && len(options.StreamFilter.Values) == 0 {
+		return nil, fmt.Errorf("StreamFilter needs at least one filter value")
+	}
+
+	if options.StreamFilter != nil && !c.SupportsFeature(FeatureBrokerFilter) {
+		return nil, fmt.Errorf("StreamFilter needs a server with the broker side filtering")
+	}
+
+	var lastN *lastNBuffer
+	if options.Offset.isFromDuration() || options.Offset.isLastN() {
+		offset, buffer, err := options.Offset.resolve(c, streamName)
+		if err != nil {
+			return nil, err
+		}
+		// FromDuration and LastN are not part of the protocol,
+		// the caller's options keep them for the next consumers
+		resolved := *options
+		resolved.Offset = offset
+		options = &resolved
+		lastN = buffer
+	}
+
 	options.client = c
 	options.streamName = streamName
 	consumer := c.coordinator.NewConsumer(messagesHandler, options)
+	consumer.lastN = lastN
 	length := 2 + 2 + 4 + 1 + 2 + len(streamName) + 2 + 2
 	if options.Offset.isOffset() ||
 		options.Offset.isTimestamp() {
 		length += 8
 	}
 
+	properties := options.subscriptionProperties()
+	if len(properties) > 0 {
+		length += 4
+		for key, element := range properties {
+			length = length + 2 + len(key) + 2 + len(element)
+		}
+	}
+
 	if options.Offset.isLastConsumed() {
 		lastOffset, err := consumer.QueryOffset()
 		if err != nil {
@@ -684,6 +890,14 @@ func (c *Client) DeclareSubscriber(streamName string,
 	}
 	writeShort(b, 10)
 
+	if len(properties) > 0 {
+		writeInt(b, len(properties))
+		for key, element := range properties {
+			writeString(b, key)
+			writeString(b, element)
+		}
+	}
+
 	err := c.handleWrite(b.Bytes(), resp)
 
 	go func() {
@@ -699,11 +913,16 @@ func (c *Client) DeclareSubscriber(streamName string,
 
 			case messages := <-consumer.response.messages:
 				for _, message := range messages {
-					consumer.MessagesHandler(ConsumerContext{Consumer: consumer}, message)
+					consumer.handleMessage(ConsumerContext{Consumer: consumer,
+						Message: message.context(streamName)}, message.message)
 				}
+				atomic.AddInt32(&consumer.pendingChunks, -1)
 
 			}
 		}
 	}()
+	if err.Err == nil {
+		c.emit(LifecycleEvent{Type: EventConsumerAdded, StreamName: streamName, Name: options.ConsumerName})
+	}
 	return consumer, err.Err
 }
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -121,12 +122,24 @@ var _ = Describe("Streaming testEnvironment", func() {
 
 	})
 
+	It("Create Stream with SetInitialClusterSize, SetLeaderLocator and SetArgument", func() {
+		streamP := uuid.New().String()
+		err := testEnvironment.DeclareStream(streamP,
+			NewStreamOptions().
+				SetInitialClusterSize(1).
+				SetLeaderLocator(LeaderLocatorClientLocal).
+				SetArgument("x-queue-type", "stream"))
+		Expect(err).NotTo(HaveOccurred())
+		err = testEnvironment.DeleteStream(streamP)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	It("Create two times Stream", func() {
 		err := testEnvironment.DeclareStream(testStreamName, nil)
 		Expect(err).NotTo(HaveOccurred())
 		err = testEnvironment.DeclareStream(testStreamName, nil)
 		Expect(err).To(HaveOccurred())
-		Expect(err).To(Equal(StreamAlreadyExists))
+		Expect(err).To(MatchError(StreamAlreadyExists))
 		err = testEnvironment.DeleteStream(testStreamName)
 		Expect(err).NotTo(HaveOccurred())
 	})
@@ -140,7 +153,28 @@ var _ = Describe("Streaming testEnvironment", func() {
 				MaxLengthBytes: ByteCapacity{}.MB(100),
 			})
 		Expect(err).To(HaveOccurred())
-		Expect(err).To(Equal(PreconditionFailed))
+		Expect(err).To(MatchError(PreconditionFailed))
+		err = testEnvironment.DeleteStream(testStreamName)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Ensure Stream", func() {
+		options := NewStreamOptions().SetMaxLengthBytes(ByteCapacity{}.MB(100))
+		err := testEnvironment.EnsureStream(testStreamName, options)
+		Expect(err).NotTo(HaveOccurred())
+		err = testEnvironment.DeclareStreamIfNotExists(testStreamName, options)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testEnvironment.EnsureStream(testStreamName,
+			NewStreamOptions().SetMaxLengthBytes(ByteCapacity{}.MB(200)).SetInitialClusterSize(3))
+		Expect(errors.Is(err, PreconditionFailed)).To(BeTrue())
+		var mismatch *StreamOptionsMismatch
+		Expect(errors.As(err, &mismatch)).To(BeTrue())
+		Expect(mismatch.Stream).To(Equal(testStreamName))
+		Expect(mismatch.Fields).To(Equal([]StreamOptionsDiff{
+			{Field: "InitialClusterSize", Desired: "3", Actual: "1"}}))
+		Expect(mismatch.Unverified).To(Equal([]string{"MaxLengthBytes"}))
+
 		err = testEnvironment.DeleteStream(testStreamName)
 		Expect(err).NotTo(HaveOccurred())
 	})
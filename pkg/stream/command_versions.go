@@ -0,0 +1,154 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// Feature is a capability that depends on the command versions
+// supported by the server
+type Feature string
+
+const (
+	// FeatureCommandVersions the server can exchange the command versions
+	FeatureCommandVersions Feature = "command-versions"
+	// FeatureBrokerFilter the server supports the publish v2 frame
+	// with the filter value, see ProducerOptions.FilterValue
+	FeatureBrokerFilter Feature = "broker-filter"
+	// FeatureStreamStats the server returns the stream statistics,
+	// see Client.StreamStats
+	FeatureStreamStats Feature = "stream-stats"
+)
+
+type commandVersion struct {
+	minVersion uint16
+	maxVersion uint16
+}
+
+// clientCommandVersions are the versions the client can handle
+var clientCommandVersions = map[uint16]commandVersion{
+	commandDeclarePublisher:       {version1, version1},
+	commandPublish:                {version1, version2},
+	commandQueryPublisherSequence: {version1, version1},
+	CommandDeletePublisher:        {version1, version1},
+	commandSubscribe:              {version1, version1},
+	commandDeliver:                {version1, version1},
+	commandCredit:                 {version1, version1},
+	commandStoreOffset:            {version1, version1},
+	CommandQueryOffset:            {version1, version1},
+	CommandUnsubscribe:            {version1, version1},
+	commandCreateStream:           {version1, version1},
+	commandDeleteStream:           {version1, version1},
+	commandMetadata:               {version1, version1},
+	CommandMetadataUpdate:         {version1, version1},
+	commandHeartbeat:              {version1, version1},
+	commandExchangeVersion:        {version1, version1},
+	commandStreamStats:            {version1, version1},
+}
+
+// featureCommandVersion is the command version needed by each feature
+var featureCommandVersion = map[Feature]struct {
+	command uint16
+	version uint16
+}{
+	FeatureCommandVersions: {commandExchangeVersion, version1},
+	FeatureBrokerFilter:    {commandPublish, version2},
+	FeatureStreamStats:     {commandStreamStats, version1},
+}
+
+// the first server version able to exchange the command versions
+const (
+	minServerMajorExchangeVersion = 3
+	minServerMinorExchangeVersion = 11
+)
+
+// serverSupportsExchangeVersion checks the server version, sending
+// the exchange command to an older server closes the connection
+func serverSupportsExchangeVersion(serverVersion string) bool {
+	return versionAtLeast(serverVersion, minServerMajorExchangeVersion, minServerMinorExchangeVersion)
+}
+
+// negotiateCommandVersions returns, for each command supported by both
+// sides, the highest version both sides can handle
+func negotiateCommandVersions(serverVersions map[uint16]commandVersion) map[uint16]uint16 {
+	negotiated := map[uint16]uint16{}
+	for command, clientVersion := range clientCommandVersions {
+		serverVersion, ok := serverVersions[command]
+		if !ok {
+			continue
+		}
+		maxVersion := clientVersion.maxVersion
+		if serverVersion.maxVersion < maxVersion {
+			maxVersion = serverVersion.maxVersion
+		}
+		if maxVersion >= clientVersion.minVersion && maxVersion >= serverVersion.minVersion {
+			negotiated[command] = maxVersion
+		}
+	}
+	return negotiated
+}
+
+func (c *Client) exchangeCommandVersions() error {
+	length := 2 + 2 + 4 + 4 + len(clientCommandVersions)*(2+2+2)
+	resp := c.coordinator.NewResponse(commandExchangeVersion)
+	correlationId := resp.correlationid
+	var b = bytes.NewBuffer(make([]byte, 0, length+4))
+	writeProtocolHeader(b, length, commandExchangeVersion,
+		correlationId)
+	writeInt(b, len(clientCommandVersions))
+	for command, version := range clientCommandVersions {
+		writeUShort(b, command)
+		writeUShort(b, version.minVersion)
+		writeUShort(b, version.maxVersion)
+	}
+
+	err := c.handleWriteWithResponse(b.Bytes(), resp, false)
+	if err.Err != nil {
+		if !err.isTimeout {
+			// the data follows the code also in case of error
+			<-resp.data
+		}
+		_ = c.coordinator.RemoveResponseById(resp.correlationid)
+		return err.Err
+	}
+
+	serverVersions := <-resp.data
+	_ = c.coordinator.RemoveResponseById(resp.correlationid)
+	// called during connect, the client mutex is already locked
+	c.commandVersions = negotiateCommandVersions(serverVersions.(map[uint16]commandVersion))
+	return nil
+}
+
+func (c *Client) handleExchangeVersionResponse(readProtocol *ReaderProtocol, r *bufio.Reader) {
+	readProtocol.CorrelationId, _ = readUInt(r)
+	readProtocol.ResponseCode = uShortExtractResponseCode(readUShort(r))
+	commandsCount, _ := readUInt(r)
+	serverVersions := map[uint16]commandVersion{}
+	for i := 0; i < int(commandsCount); i++ {
+		command := readUShort(r)
+		serverVersions[command] = commandVersion{
+			minVersion: readUShort(r),
+			maxVersion: readUShort(r),
+		}
+	}
+	res, err := c.coordinator.GetResponseById(readProtocol.CorrelationId)
+	if err != nil {
+		// TODO handle readProtocol
+		return
+	}
+	res.code <- Code{id: readProtocol.ResponseCode}
+	res.data <- serverVersions
+}
+
+// SupportsFeature tells if the feature is available on the connection,
+// given the command versions negotiated with the server
+func (c *Client) SupportsFeature(feature Feature) bool {
+	required, ok := featureCommandVersion[feature]
+	if !ok {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	version, ok := c.commandVersions[required.command]
+	return ok && version >= required.version
+}
@@ -0,0 +1,50 @@
+package stream
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command versions", func() {
+
+	It("Server version able to exchange the command versions", func() {
+		Expect(serverSupportsExchangeVersion("3.11.0")).To(BeTrue())
+		Expect(serverSupportsExchangeVersion("3.13.0-rc.1")).To(BeTrue())
+		Expect(serverSupportsExchangeVersion("4.0.0")).To(BeTrue())
+		Expect(serverSupportsExchangeVersion("3.10.2")).To(BeFalse())
+		Expect(serverSupportsExchangeVersion("3.9")).To(BeFalse())
+		Expect(serverSupportsExchangeVersion("")).To(BeFalse())
+		Expect(serverSupportsExchangeVersion("master")).To(BeFalse())
+	})
+
+	It("Negotiate command versions", func() {
+		negotiated := negotiateCommandVersions(map[uint16]commandVersion{
+			commandPublish:   {version1, version2},
+			commandSubscribe: {version1, version1},
+			// unknown to the client
+			99: {version1, version1},
+		})
+		Expect(negotiated).To(Equal(map[uint16]uint16{
+			commandPublish:   version2,
+			commandSubscribe: version1,
+		}))
+
+		negotiated = negotiateCommandVersions(map[uint16]commandVersion{
+			commandPublish: {version1, version1},
+		})
+		Expect(negotiated[commandPublish]).To(Equal(uint16(version1)))
+	})
+
+	It("Supports feature", func() {
+		client := newClient("test-client", nil)
+		Expect(client.SupportsFeature(FeatureBrokerFilter)).To(BeFalse())
+		client.commandVersions = negotiateCommandVersions(map[uint16]commandVersion{
+			commandPublish:         {version1, version2},
+			commandExchangeVersion: {version1, version1},
+		})
+		Expect(client.SupportsFeature(FeatureBrokerFilter)).To(BeTrue())
+		Expect(client.SupportsFeature(FeatureCommandVersions)).To(BeTrue())
+		Expect(client.SupportsFeature("unknown")).To(BeFalse())
+	})
+
+})
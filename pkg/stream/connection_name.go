@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders for EnvironmentOptions.ProducerConnectionName and
+// EnvironmentOptions.ConsumerConnectionName, for example:
+// "{application}-{hostname}-producer-{sequence}"
+const (
+	ConnectionNameApplication = "{application}"
+	ConnectionNameHostname    = "{hostname}"
+	ConnectionNameStream      = "{stream}"
+	ConnectionNameSequence    = "{sequence}"
+)
+
+const (
+	connectionKindLocator  = "locator"
+	connectionKindProducer = "producer"
+	connectionKindConsumer = "consumer"
+)
+
+// connectionName resolves the connection name template of the kind.
+// Without template the name is go-stream-<kind>, or <application>-<kind>
+// when the application name is set.
+// streamName is the stream of the entity that opened the connection.
+func (envOptions *EnvironmentOptions) connectionName(kind string, streamName string, sequence int) string {
+	template := ""
+	switch kind {
+	case connectionKindProducer:
+		template = envOptions.ProducerConnectionName
+	case connectionKindConsumer:
+		template = envOptions.ConsumerConnectionName
+	}
+	if template == "" {
+		if envOptions.ApplicationName != "" {
+			return envOptions.ApplicationName + "-" + kind
+		}
+		return "go-stream-" + kind
+	}
+
+	hostname, _ := os.Hostname()
+	return strings.NewReplacer(
+		ConnectionNameApplication, envOptions.ApplicationName,
+		ConnectionNameHostname, hostname,
+		ConnectionNameStream, streamName,
+		ConnectionNameSequence, strconv.Itoa(sequence),
+	).Replace(template)
+}
+
+func newEnvironmentClient(kind string, broker *Broker, options *EnvironmentOptions,
+	streamName string, sequence int) *Client {
+	client := newClient(options.connectionName(kind, streamName, sequence), broker)
+	client.setClientProperties(options.ClientProperties)
+	client.clientTuneState = TuneState{
+		requestedMaxFrameSize: options.RequestedMaxFrameSize,
+		requestedHeartbeat:    int(options.RequestedHeartbeat / time.Second),
+	}
+	if options.RequestedHeartbeat == NoHeartbeat {
+		client.clientTuneState.requestedHeartbeat = 0
+	}
+	if options.ApplicationName != "" {
+		client.clientProperties.items["application"] = options.ApplicationName
+	}
+	return client
+}
@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection names", func() {
+
+	It("Default names", func() {
+		options := NewEnvironmentOptions()
+		Expect(options.connectionName(connectionKindLocator, "", 0)).To(Equal("go-stream-locator"))
+		Expect(options.connectionName(connectionKindProducer, "orders", 1)).To(Equal("go-stream-producer"))
+		Expect(options.connectionName(connectionKindConsumer, "orders", 1)).To(Equal("go-stream-consumer"))
+
+		options.SetApplicationName("billing")
+		Expect(options.connectionName(connectionKindProducer, "orders", 1)).To(Equal("billing-producer"))
+		Expect(options.connectionName(connectionKindLocator, "", 0)).To(Equal("billing-locator"))
+	})
+
+	It("Templates", func() {
+		hostname, _ := os.Hostname()
+		options := NewEnvironmentOptions().SetApplicationName("billing").
+			SetProducerConnectionName("{application}-{hostname}-{stream}-{sequence}").
+			SetConsumerConnectionName("{application}-consumer")
+		Expect(options.connectionName(connectionKindProducer, "orders", 3)).
+			To(Equal("billing-" + hostname + "-orders-3"))
+		Expect(options.connectionName(connectionKindConsumer, "orders", 3)).
+			To(Equal("billing-consumer"))
+	})
+
+	It("Client properties", func() {
+		options := NewEnvironmentOptions().SetApplicationName("billing").
+			SetClientProperty("team", "payments").
+			SetClientProperty("connection_name", "ignored")
+		client := newEnvironmentClient(connectionKindProducer, nil, options, "orders", 1)
+		Expect(client.clientProperties.items["connection_name"]).To(Equal("billing-producer"))
+		Expect(client.clientProperties.items["team"]).To(Equal("payments"))
+		Expect(client.clientProperties.items["application"]).To(Equal("billing"))
+	})
+
+})
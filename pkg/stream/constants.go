@@ -11,12 +11,25 @@ import (
 // for example the producer status
 
 const (
-	open   = iota
-	closed = iota
+	open     = iota
+	closed   = iota
+	draining = iota
 )
 
 const initBufferPublishSize = 2 + 2 + 1 + 4
 
+// publishingId + message length
+const publishEntryHeaderSize = 8 + 4
+
+// the subscription properties used by the broker side filtering
+const (
+	subscriptionPropertyFilterPrefix    = "filter."
+	subscriptionPropertyMatchUnfiltered = "match-unfiltered"
+)
+
+// the frame length prefix, not counted in the frame length itself
+const frameLengthSize = 4
+
 const (
 	commandDeclarePublisher       = 1
 	commandPublish                = 2
@@ -41,11 +54,14 @@ const (
 	commandOpen                   = 21
 	CommandClose                  = 22
 	commandHeartbeat              = 23
+	commandExchangeVersion        = 27
+	commandStreamStats            = 28
 
 	/// used only for tests
 	commandUnitTest = 99
 
 	version1    = 1
+	version2    = 2
 	unicodeNull = "\u0000"
 
 	responseCodeOk                            = uint16(1)
@@ -66,6 +82,7 @@ const (
 	responseCodeAccessRefused                 = uint16(16)
 	responseCodePreconditionFailed            = uint16(17)
 	responseCodePublisherDoesNotExist         = uint16(18)
+	responseCodeOffsetNotFound                = uint16(19)
 
 	/// responses out of protocol
 	closeChannel = uint16(60)
@@ -84,6 +101,30 @@ const (
 	minBatchSize     = 1
 	maxBatchSize     = 10_000
 	defaultBatchSize = 100
+	defaultLinger    = 200 * time.Millisecond
+
+	minConfirmTimeout = 100 * time.Millisecond
+
+	defaultRequestedMaxFrameSize = 1048576
+	minRequestedMaxFrameSize     = 8192
+	defaultRequestedHeartbeat    = 60 * time.Second
+
+	// NoHeartbeat is the EnvironmentOptions.RequestedHeartbeat
+	// that disables the heartbeat
+	NoHeartbeat = time.Duration(-1)
+
+	defaultBackoffInitialDelay   = 500 * time.Millisecond
+	defaultBackoffMaxDelay       = 10 * time.Second
+	defaultBackoffMaxElapsedTime = 60 * time.Second
+
+	defaultEventsBufferSize = 256
+
+	rebalanceConfirmTimeout = 5 * time.Second
+
+	defaultReaderBufferSize = 1000
+
+	defaultDeadLetterAttempts     = 3
+	defaultDeadLetterInitialDelay = 100 * time.Millisecond
 	//
 	ClientVersion = "0.10-alpha"
 
@@ -99,8 +140,22 @@ var StreamAlreadyExists = errors.New("Stream Already Exists")
 var VirtualHostAccessFailure = errors.New("Virtual Host Access Failure")
 var SubscriptionIdDoesNotExist = errors.New("Subscription Id Does Not Exist")
 var PublisherDoesNotExist = errors.New("Publisher Does Not Exist")
+var OffsetNotFound = errors.New("Offset Not Found")
 var FrameTooLarge = errors.New("Frame Too Large, the buffer is too big")
 var CodeAccessRefused = errors.New("Resources Access Refused")
+var SubscriptionIdAlreadyExists = errors.New("Subscription Id Already Exists")
+var StreamNotAvailable = errors.New("Stream Not Available")
+var SaslMechanismNotSupported = errors.New("Sasl Mechanism Not Supported")
+var SaslError = errors.New("Sasl Error")
+var SaslChallenge = errors.New("Sasl Challenge")
+var AuthenticationFailureLoopback = errors.New("Authentication Failure Loopback")
+var UnknownFrame = errors.New("Unknown Frame")
+var InternalError = errors.New("Internal Error")
+var UnknownResponseCode = errors.New("Unknown Response Code")
+var ConfirmationTimeout = errors.New("Confirmation Timeout")
+var ShuttingDown = errors.New("Shutting Down")
+var EndOfStream = errors.New("End Of Stream")
+var AdvertisedAddressMismatch = errors.New("Connected to a node different from the advertised one")
 
 func lookErrorCode(errorCode uint16) error {
 	switch errorCode {
@@ -118,43 +173,65 @@ func lookErrorCode(errorCode uint16) error {
 		return SubscriptionIdDoesNotExist
 	case responseCodePublisherDoesNotExist:
 		return PublisherDoesNotExist
+	case responseCodeOffsetNotFound:
+		return OffsetNotFound
 	case responseCodePreconditionFailed:
 		return PreconditionFailed
 	case responseCodeFrameTooLarge:
 		return FrameTooLarge
 	case responseCodeAccessRefused:
 		return CodeAccessRefused
+	case responseCodeSubscriptionIdAlreadyExists:
+		return SubscriptionIdAlreadyExists
+	case responseCodeStreamNotAvailable:
+		return StreamNotAvailable
+	case responseCodeSaslMechanismNotSupported:
+		return SaslMechanismNotSupported
+	case responseCodeSaslError:
+		return SaslError
+	case responseCodeSaslChallenge:
+		return SaslChallenge
+	case responseCodeAuthenticationFailureLoopback:
+		return AuthenticationFailureLoopback
+	case responseCodeUnknownFrame:
+		return UnknownFrame
+	case responseCodeInternalError:
+		return InternalError
 	default:
 		{
 			logs.LogWarn("Error not handled %d", errorCode)
-			return errors.New("Generic Error")
+			return UnknownResponseCode
 		}
 	}
 }
 
 func lookUpCommand(command uint16) string {
 	var constLookup = map[uint16]string{
-		commandPeerProperties:   `commandPeerProperties`,
-		commandSaslHandshake:    `commandSaslHandshake`,
-		commandSaslAuthenticate: `commandSaslAuthenticate`,
-		commandTune:             `commandTune`,
-		commandOpen:             `commandOpen`,
-		commandHeartbeat:        `commandHeartbeat`,
-		CommandMetadataUpdate:   `CommandMetadataUpdate`,
-		commandMetadata:         `CommandMetadata`,
-		commandDeleteStream:     `CommandDeleteStream`,
-		commandCreateStream:     `CommandCreateStream`,
-		CommandUnsubscribe:      `CommandUnsubscribe`,
-		CommandQueryOffset:      `CommandQueryOffset`,
-		commandCredit:           `CommandCredit`,
-		commandDeliver:          `CommandDeliver`,
-		commandSubscribe:        `CommandSubscribe`,
-		CommandDeletePublisher:  `CommandDeletePublisher`,
-		commandPublishError:     `CommandPublishError`,
-		commandPublishConfirm:   `CommandPublishConfirm`,
-		commandDeclarePublisher: `CommandDeclarePublisher`,
-		commandUnitTest:         `UnitTest`,
-		CommandClose:            `CommandClose`,
+		commandPeerProperties:         `commandPeerProperties`,
+		commandSaslHandshake:          `commandSaslHandshake`,
+		commandSaslAuthenticate:       `commandSaslAuthenticate`,
+		commandTune:                   `commandTune`,
+		commandOpen:                   `commandOpen`,
+		commandHeartbeat:              `commandHeartbeat`,
+		CommandMetadataUpdate:         `CommandMetadataUpdate`,
+		commandMetadata:               `CommandMetadata`,
+		commandDeleteStream:           `CommandDeleteStream`,
+		commandCreateStream:           `CommandCreateStream`,
+		CommandUnsubscribe:            `CommandUnsubscribe`,
+		CommandQueryOffset:            `CommandQueryOffset`,
+		commandCredit:                 `CommandCredit`,
+		commandDeliver:                `CommandDeliver`,
+		commandSubscribe:              `CommandSubscribe`,
+		CommandDeletePublisher:        `CommandDeletePublisher`,
+		commandPublishError:           `CommandPublishError`,
+		commandPublishConfirm:         `CommandPublishConfirm`,
+		commandDeclarePublisher:       `CommandDeclarePublisher`,
+		commandUnitTest:               `UnitTest`,
+		CommandClose:                  `CommandClose`,
+		commandExchangeVersion:        `CommandExchangeVersion`,
+		commandPublish:                `CommandPublish`,
+		commandQueryPublisherSequence: `CommandQueryPublisherSequence`,
+		commandStreamStats:            `CommandStreamStats`,
 	}
 	if constLookup[command] == "" {
 		return fmt.Sprintf("Command not handled %d", command)
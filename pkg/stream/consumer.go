@@ -2,10 +2,14 @@ package stream
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
 	logs "github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Consumer struct {
@@ -21,6 +25,12 @@ type Consumer struct {
 	closeHandler  chan Event
 
 	status int
+	// chunks delivered and not yet handled, see drain
+	pendingChunks int32
+	// 1 when ConsumerOptions.Until is reached
+	untilReached int32
+	// not nil when the consumer starts from LastN
+	lastN *lastNBuffer
 }
 
 func (consumer *Consumer) setStatus(status int) {
@@ -70,16 +80,64 @@ func (consumer *Consumer) NotifyClose() ChannelClose {
 
 type ConsumerContext struct {
 	Consumer *Consumer
+	Message  MessageContext
+}
+
+// MessageContext is the position of a delivered message in the stream
+type MessageContext struct {
+	StreamName string
+	Offset     int64
+	// ChunkTimestamp is when the chunk of the message was written
+	ChunkTimestamp time.Time
+}
+
+// offsetMessage is a delivered message with its position
+type offsetMessage struct {
+	message        *amqp.Message
+	offset         int64
+	chunkTimestamp int64
+}
+
+func (m offsetMessage) context(streamName string) MessageContext {
+	return MessageContext{
+		StreamName:     streamName,
+		Offset:         m.offset,
+		ChunkTimestamp: time.Unix(0, m.chunkTimestamp*int64(time.Millisecond)),
+	}
 }
 
 type MessagesHandler func(consumerContext ConsumerContext, message *amqp.Message)
 
+// handleMessage calls the MessagesHandler, a panic of the handler
+// is logged and the delivery goes on with the next message
+func (consumer *Consumer) handleMessage(consumerContext ConsumerContext, message *amqp.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logs.LogWarn("consumer id: %d, stream: %s, the handler panicked at offset %d: %v",
+				consumer.ID, consumer.GetStreamName(), consumerContext.Message.Offset, r)
+		}
+	}()
+	consumer.MessagesHandler(consumerContext, message)
+}
+
 type /**/ ConsumerOptions struct {
 	client       *Client
 	ConsumerName string
 	streamName   string
 	autocommit   bool
 	Offset       OffsetSpecification
+	Filter       MessageFilter
+	StreamFilter *StreamFilter
+	// PlacementPolicy chooses the node of the consumer connection,
+	// it overrides EnvironmentOptions.ConsumerPlacementPolicy
+	PlacementPolicy ConsumerPlacementPolicy
+	// Until closes the consumer after the offset or the timestamp,
+	// see SetUntil
+	Until OffsetSpecification
+	// the consumer closes after the chunk tailChunkId,
+	// when stopAtTail is set, see StreamReaderOptions.StopAtTail
+	stopAtTail  bool
+	tailChunkId int64
 }
 
 func NewConsumerOptions() *ConsumerOptions {
@@ -106,6 +164,66 @@ func (c *ConsumerOptions) SetOffset(offset OffsetSpecification) *ConsumerOptions
 	return c
 }
 
+func (c *ConsumerOptions) SetFilter(filter MessageFilter) *ConsumerOptions {
+	c.Filter = filter
+	return c
+}
+
+func (c *ConsumerOptions) SetStreamFilter(streamFilter *StreamFilter) *ConsumerOptions {
+	c.StreamFilter = streamFilter
+	return c
+}
+
+func (c *ConsumerOptions) SetPlacementPolicy(placementPolicy ConsumerPlacementPolicy) *ConsumerOptions {
+	c.PlacementPolicy = placementPolicy
+	return c
+}
+
+// SetUntil closes the consumer once it reaches the bound, an
+// OffsetSpecification Offset or Timestamp. The messages after the
+// bound are not delivered. The chunk timestamp is used, so the
+// consumer closes when the first chunk after the timestamp arrives.
+func (c *ConsumerOptions) SetUntil(until OffsetSpecification) *ConsumerOptions {
+	c.Until = until
+	return c
+}
+
+// beyondUntil is true for the offsets and the chunks after the Until bound
+func (c *ConsumerOptions) beyondUntil(offset int64, chunkTimestamp int64) bool {
+	switch c.Until.typeOfs {
+	case typeOffset:
+		return offset > c.Until.offset
+	case typeTimestamp:
+		return chunkTimestamp > c.Until.offset
+	}
+	return false
+}
+
+// atTail is true for the chunks from the tail on
+func (c *ConsumerOptions) atTail(chunkId int64) bool {
+	return c.stopAtTail && chunkId >= c.tailChunkId
+}
+
+func (c *ConsumerOptions) subscriptionProperties() map[string]string {
+	properties := map[string]string{}
+	if c.StreamFilter != nil {
+		for i, value := range c.StreamFilter.Values {
+			properties[fmt.Sprintf("%s%d", subscriptionPropertyFilterPrefix, i)] = value
+		}
+		properties[subscriptionPropertyMatchUnfiltered] = strconv.FormatBool(c.StreamFilter.MatchUnfiltered)
+	}
+	return properties
+}
+
+// accept evaluates the client side filters
+func (c *ConsumerOptions) accept(message *amqp.Message) bool {
+	if c.StreamFilter != nil && c.StreamFilter.PostFilter != nil &&
+		!c.StreamFilter.PostFilter(message) {
+		return false
+	}
+	return c.Filter == nil || c.Filter(message)
+}
+
 func (c *Client) credit(subscriptionId byte, credit int16) {
 	length := 2 + 2 + 1 + 2
 	var b = bytes.NewBuffer(make([]byte, 0, length+4))
@@ -168,7 +286,55 @@ func (consumer *Consumer) Close() error {
 	return err.Err
 }
 
+// closeAtUntil closes the consumer after the messages up to Until are handled
+func (consumer *Consumer) closeAtUntil() {
+	logs.LogDebug("consumer id: %d, stream: %s reached the Until bound",
+		consumer.ID, consumer.GetStreamName())
+	err := consumer.drain(context.Background())
+	if err != nil && err != AlreadyClosed {
+		logs.LogWarn("consumer id: %d, error closing at the Until bound: %s", consumer.ID, err)
+	}
+}
+
+// drain stops the delivery, waits for the handler to process the
+// messages already received and stores the offset, unless the consumer
+// uses ManualCommit. Then the consumer is closed.
+func (consumer *Consumer) drain(ctx context.Context) error {
+	if consumer.getStatus() != open {
+		return AlreadyClosed
+	}
+	consumer.setStatus(draining)
+
+	var ticker = time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&consumer.pendingChunks) > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	var errStore error
+	if ctx.Err() == nil && consumer.options.autocommit && consumer.options.ConsumerName != "" {
+		errStore = consumer.StoreOffset()
+	}
+	err := consumer.Close()
+	if err != nil {
+		return err
+	}
+	if errStore != nil {
+		return errStore
+	}
+	return ctx.Err()
+}
+
 func (consumer *Consumer) StoreOffset() error {
+	return consumer.StoreCustomOffset(consumer.GetOffset())
+}
+
+// StoreCustomOffset stores the offset instead of the current one,
+// for example the last message processed by the application
+func (consumer *Consumer) StoreCustomOffset(offset int64) error {
 	if consumer.options.streamName == "" {
 		return fmt.Errorf("stream Name can't be empty")
 	}
@@ -180,7 +346,7 @@ func (consumer *Consumer) StoreOffset() error {
 	writeString(b, consumer.options.ConsumerName)
 	writeString(b, consumer.options.streamName)
 
-	writeLong(b, consumer.GetOffset())
+	writeLong(b, offset)
 	return consumer.options.client.socket.writeAndFlush(b.Bytes())
 
 }
@@ -198,6 +364,11 @@ func (consumer *Consumer) QueryOffset() (int64, error) {
 	writeString(b, consumer.options.streamName)
 	err := consumer.options.client.handleWriteWithResponse(b.Bytes(), resp, false)
 	if err.Err != nil {
+		if !err.isTimeout {
+			// the offset follows the code also in case of error
+			<-resp.data
+		}
+		_ = consumer.options.client.coordinator.RemoveResponseById(resp.correlationid)
 		return 0, err.Err
 
 	}
@@ -219,11 +390,17 @@ const (
 	typeOffset       = int16(4)
 	typeTimestamp    = int16(5)
 	typeLastConsumed = int16(6)
+	// client side specifications, resolved to typeTimestamp
+	// and typeOffset when the consumer subscribes
+	typeFromDuration = int16(7)
+	typeLastN        = int16(8)
 )
 
 type OffsetSpecification struct {
 	typeOfs int16
-	offset  int64
+	// the offset, the timestamp in milliseconds, the duration
+	// of FromDuration or the n of LastN
+	offset int64
 }
 
 func (o OffsetSpecification) First() OffsetSpecification {
@@ -269,3 +446,106 @@ func (o OffsetSpecification) LastConsumed() OffsetSpecification {
 	o.offset = -1
 	return o
 }
+
+// FromDuration starts from the messages stored in the last duration,
+// for example the last 10 minutes. The time is the one of the chunks,
+// so a few older messages can be delivered.
+func (o OffsetSpecification) FromDuration(duration time.Duration) OffsetSpecification {
+	o.typeOfs = typeFromDuration
+	o.offset = int64(duration)
+	return o
+}
+
+// LastN starts from the last n messages of the stream. The stream stats
+// tell where the last chunk starts, not where it ends, so the consumer
+// reads from n messages before the last chunk and delivers only the last n
+// once the last chunk arrives, then the new messages.
+// It needs a server with FeatureStreamStats.
+func (o OffsetSpecification) LastN(n int64) OffsetSpecification {
+	o.typeOfs = typeLastN
+	o.offset = n
+	return o
+}
+
+func (o OffsetSpecification) isFromDuration() bool {
+	return o.typeOfs == typeFromDuration
+}
+
+func (o OffsetSpecification) isLastN() bool {
+	return o.typeOfs == typeLastN
+}
+
+// resolve turns the client side specifications into the ones of the
+// protocol, the buffer is not nil for LastN
+func (o OffsetSpecification) resolve(client *Client, streamName string) (OffsetSpecification, *lastNBuffer, error) {
+	switch o.typeOfs {
+	case typeFromDuration:
+		if o.offset < 0 {
+			return o, nil, fmt.Errorf("FromDuration can't be negative")
+		}
+		from := time.Now().Add(-time.Duration(o.offset))
+		return o.Timestamp(from.UnixNano() / int64(time.Millisecond)), nil, nil
+	case typeLastN:
+		if o.offset <= 0 {
+			return o, nil, fmt.Errorf("LastN must be positive")
+		}
+		stats, err := client.StreamStats(streamName)
+		if err != nil {
+			return o, nil, err
+		}
+		committed, err := stats.CommittedChunkId()
+		if err != nil {
+			return o, nil, err
+		}
+		first, err := stats.FirstOffset()
+		if err != nil {
+			return o, nil, err
+		}
+		if committed < 0 {
+			// the stream is empty
+			return o.First(), nil, nil
+		}
+		offset := committed - o.offset
+		if offset < first {
+			offset = first
+		}
+		return o.Offset(offset), &lastNBuffer{n: int(o.offset), committedChunkId: committed}, nil
+	}
+	return o, nil, nil
+}
+
+// lastNBuffer keeps the last n messages read before the last chunk,
+// see OffsetSpecification.LastN. It is used by the connection reader only.
+type lastNBuffer struct {
+	n                int
+	committedChunkId int64
+	// a ring of up to n messages, next is the oldest once it is full
+	messages []offsetMessage
+	next     int
+	done     bool
+}
+
+// add returns the messages of the chunk to deliver: none before the
+// last chunk, then the last n, then all the messages
+func (b *lastNBuffer) add(chunkId int64, messages []offsetMessage) []offsetMessage {
+	if b.done {
+		return messages
+	}
+	for _, message := range messages {
+		if len(b.messages) < b.n {
+			b.messages = append(b.messages, message)
+			continue
+		}
+		b.messages[b.next] = message
+		b.next = (b.next + 1) % b.n
+	}
+	if chunkId < b.committedChunkId {
+		return nil
+	}
+	b.done = true
+	res := make([]offsetMessage, 0, len(b.messages))
+	res = append(res, b.messages[b.next:]...)
+	res = append(res, b.messages[:b.next]...)
+	b.messages = nil
+	return res
+}
@@ -239,6 +239,70 @@ var _ = Describe("Streaming Consumers", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
+	It("Client side filter", func() {
+		producer, err := env.NewProducer(streamName, nil)
+		Expect(err).NotTo(HaveOccurred())
+		var arr []message.StreamMessage
+		for z := 0; z < 100; z++ {
+			m := amqp.NewMessage([]byte("test_" + strconv.Itoa(z)))
+			m.SetApplicationProperties(map[string]interface{}{"even": z%2 == 0})
+			arr = append(arr, m)
+		}
+		err = producer.BatchSend(arr)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(500 * time.Millisecond)
+		err = producer.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		var messagesCount int32 = 0
+		consumer, err := env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				atomic.AddInt32(&messagesCount, 1)
+			}, NewConsumerOptions().SetOffset(OffsetSpecification{}.First()).
+				SetFilter(PropertyEquals("even", true)))
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(500 * time.Millisecond)
+		Expect(atomic.LoadInt32(&messagesCount)).To(Equal(int32(50)))
+		// the filtered messages move the offset too
+		Expect(consumer.GetOffset()).To(Equal(int64(100)))
+		err = consumer.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Broker side filter", func() {
+		producer, err := env.NewProducer(streamName, NewProducerOptions().
+			SetFilterValue(func(message message.StreamMessage) string {
+				return message.(*amqp.AMQP10).GetApplicationProperties()["tenant"].(string)
+			}))
+		Expect(err).NotTo(HaveOccurred())
+		for _, tenant := range []string{"blue", "red"} {
+			var arr []message.StreamMessage
+			for z := 0; z < 50; z++ {
+				m := amqp.NewMessage([]byte("test_" + strconv.Itoa(z)))
+				m.SetApplicationProperties(map[string]interface{}{"tenant": tenant})
+				arr = append(arr, m)
+			}
+			err = producer.BatchSend(arr)
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(200 * time.Millisecond)
+		}
+		err = producer.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		var messagesCount int32 = 0
+		consumer, err := env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				Expect(message.ApplicationProperties["tenant"]).To(Equal("blue"))
+				atomic.AddInt32(&messagesCount, 1)
+			}, NewConsumerOptions().SetOffset(OffsetSpecification{}.First()).
+				SetStreamFilter(NewStreamFilter([]string{"blue"}, PropertyEquals("tenant", "blue"))))
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(500 * time.Millisecond)
+		Expect(atomic.LoadInt32(&messagesCount)).To(Equal(int32(50)))
+		err = consumer.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	It("Check already closed", func() {
 		producer, err := env.NewProducer(streamName, nil)
 		Expect(err).NotTo(HaveOccurred())
@@ -266,6 +330,142 @@ var _ = Describe("Streaming Consumers", func() {
 
 	})
 
+	It("FromDuration and Until offset", func() {
+		producer, err := env.NewProducer(streamName, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.BatchSend(CreateArrayMessagesForTesting(100))).NotTo(HaveOccurred())
+		Eventually(producer.lenUnConfirmed, 5*time.Second).Should(Equal(0))
+		Expect(producer.Close()).NotTo(HaveOccurred())
+
+		var messagesCount int32
+		options := NewConsumerOptions().
+			SetOffset(OffsetSpecification{}.FromDuration(time.Minute)).
+			SetUntil(OffsetSpecification{}.Offset(49))
+		consumer, err := env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				atomic.AddInt32(&messagesCount, 1)
+			}, options)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(consumer.getStatus, 5*time.Second).Should(Equal(closed))
+		Expect(atomic.LoadInt32(&messagesCount)).To(Equal(int32(50)))
+		Expect(consumer.GetOffset()).To(Equal(int64(50)))
+		// the options can be used again
+		Expect(options.Offset.isFromDuration()).To(BeTrue())
+	})
+
+	It("Resume after an Until timestamp", func() {
+		producer, err := env.NewProducer(streamName, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.BatchSend(CreateArrayMessagesForTesting(50))).NotTo(HaveOccurred())
+		Eventually(producer.lenUnConfirmed, 5*time.Second).Should(Equal(0))
+		time.Sleep(100 * time.Millisecond)
+		until := time.Now().UnixNano() / int64(time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		Expect(producer.BatchSend(CreateArrayMessagesForTesting(50))).NotTo(HaveOccurred())
+		Eventually(producer.lenUnConfirmed, 5*time.Second).Should(Equal(0))
+		Expect(producer.Close()).NotTo(HaveOccurred())
+
+		var messagesCount int32
+		consumer, err := env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				atomic.AddInt32(&messagesCount, 1)
+			}, NewConsumerOptions().SetConsumerName("until_timestamp").
+				SetOffset(OffsetSpecification{}.First()).
+				SetUntil(OffsetSpecification{}.Timestamp(until)))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(consumer.getStatus, 5*time.Second).Should(Equal(closed))
+		Expect(atomic.LoadInt32(&messagesCount)).To(Equal(int32(50)))
+
+		// the chunk after the bound is delivered by the next run
+		var first int64 = -1
+		consumer, err = env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				atomic.CompareAndSwapInt64(&first, -1, consumerContext.Message.Offset)
+				atomic.AddInt32(&messagesCount, 1)
+			}, NewConsumerOptions().SetConsumerName("until_timestamp").
+				SetOffset(OffsetSpecification{}.LastConsumed()))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() int32 { return atomic.LoadInt32(&messagesCount) }, 5*time.Second).
+			Should(Equal(int32(100)))
+		Expect(atomic.LoadInt64(&first)).To(Equal(int64(50)))
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+	})
+
+	It("LastN", func() {
+		producer, err := env.NewProducer(streamName, nil)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 10; i++ {
+			Expect(producer.BatchSend(CreateArrayMessagesForTesting(10))).NotTo(HaveOccurred())
+		}
+		Eventually(producer.lenUnConfirmed, 5*time.Second).Should(Equal(0))
+		Expect(producer.Close()).NotTo(HaveOccurred())
+
+		locator, err := env.getLocator()
+		Expect(err).NotTo(HaveOccurred())
+		if !locator.SupportsFeature(FeatureStreamStats) {
+			Skip("the server doesn't return the stream stats")
+		}
+
+		var messagesCount int32
+		var first int64 = -1
+		consumer, err := env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				atomic.CompareAndSwapInt64(&first, -1, consumerContext.Message.Offset)
+				atomic.AddInt32(&messagesCount, 1)
+			}, NewConsumerOptions().SetOffset(OffsetSpecification{}.LastN(5)))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() int32 { return atomic.LoadInt32(&messagesCount) }, 5*time.Second).
+			Should(Equal(int32(5)))
+		Consistently(func() int32 { return atomic.LoadInt32(&messagesCount) }, 500*time.Millisecond).
+			Should(Equal(int32(5)))
+		Expect(atomic.LoadInt64(&first)).To(Equal(int64(95)))
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+	})
+
+	It("LastN buffer", func() {
+		messages := func(from, to int64) []offsetMessage {
+			var res []offsetMessage
+			for i := from; i < to; i++ {
+				res = append(res, offsetMessage{offset: i})
+			}
+			return res
+		}
+		offsets := func(messages []offsetMessage) []int64 {
+			var res []int64
+			for _, m := range messages {
+				res = append(res, m.offset)
+			}
+			return res
+		}
+		buffer := &lastNBuffer{n: 3, committedChunkId: 20}
+		Expect(buffer.add(0, messages(0, 10))).To(BeEmpty())
+		Expect(buffer.add(10, messages(10, 20))).To(BeEmpty())
+		Expect(offsets(buffer.add(20, messages(20, 22)))).To(Equal([]int64{19, 20, 21}))
+		Expect(offsets(buffer.add(22, messages(22, 24)))).To(Equal([]int64{22, 23}))
+	})
+
+	It("Offset specifications", func() {
+		spec, _, err := OffsetSpecification{}.FromDuration(time.Minute).resolve(nil, streamName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.isTimestamp()).To(BeTrue())
+		expected := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+		Expect(spec.offset).To(BeNumerically("~", expected, 1000))
+
+		_, _, err = OffsetSpecification{}.FromDuration(-time.Minute).resolve(nil, streamName)
+		Expect(err).To(HaveOccurred())
+		_, _, err = OffsetSpecification{}.LastN(0).resolve(nil, streamName)
+		Expect(err).To(HaveOccurred())
+
+		options := NewConsumerOptions()
+		Expect(options.beyondUntil(1000, 1000)).To(BeFalse())
+		options.SetUntil(OffsetSpecification{}.Offset(10))
+		Expect(options.beyondUntil(10, 0)).To(BeFalse())
+		Expect(options.beyondUntil(11, 0)).To(BeTrue())
+		options.SetUntil(OffsetSpecification{}.Timestamp(500))
+		Expect(options.beyondUntil(1000, 500)).To(BeFalse())
+		Expect(options.beyondUntil(0, 501)).To(BeTrue())
+	})
+
 	It("Validation", func() {
 		_, err := env.NewConsumer(streamName,
 			func(consumerContext ConsumerContext, message *amqp.Message) {
@@ -274,6 +474,16 @@ var _ = Describe("Streaming Consumers", func() {
 			})
 		Expect(err).To(HaveOccurred())
 
+		_, err = env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+			}, NewConsumerOptions().SetStreamFilter(NewStreamFilter(nil, nil)))
+		Expect(err).To(HaveOccurred())
+
+		_, err = env.NewConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+			}, NewConsumerOptions().SetUntil(OffsetSpecification{}.First()))
+		Expect(err).To(HaveOccurred())
+
 	})
 
 })
@@ -3,7 +3,6 @@ package stream
 import (
 	"fmt"
 	"github.com/pkg/errors"
-	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
 	"strconv"
 	"sync"
 	"time"
@@ -17,6 +16,8 @@ type Coordinator struct {
 	nextItemProducer uint8
 	nextItemConsumer uint8
 	mutex            *sync.Mutex
+	// notify publishes the lifecycle events, nil when they are disabled
+	notify func(event LifecycleEvent)
 }
 
 type Code struct {
@@ -26,9 +27,11 @@ type Code struct {
 type Response struct {
 	code               chan Code
 	data               chan interface{}
-	messages           chan []*amqp.Message
+	messages           chan []offsetMessage
 	commandDescription string
 	correlationid      int
+	commandId          uint16
+	streamName         string
 }
 
 func NewCoordinator() *Coordinator {
@@ -58,14 +61,30 @@ func (coordinator *Coordinator) NewProducer(
 		unConfirmedMessages: map[int64]*UnConfirmedMessage{},
 		status:              open,
 		messageSequenceCh:   make(chan messageSequence, size),
+		flushCh:             make(chan chan struct{}),
+		closedCh:            make(chan struct{}),
 		pendingMessages: pendingMessagesSequence{
 			messages: make([]messageSequence, 0),
 			size:     initBufferPublishSize,
 		}}
+	if parameters != nil && parameters.MaxInFlight > 0 {
+		producer.inFlight = make(chan struct{}, parameters.MaxInFlight)
+	}
 	coordinator.producers[lastId] = producer
 	return producer, err
 }
 
+// reuseProducerId adds the producer with its current ID,
+// the next IDs don't overlap it
+func (coordinator *Coordinator) reuseProducerId(producer *Producer) {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	coordinator.producers[producer.ID] = producer
+	if producer.ID >= coordinator.nextItemProducer && producer.ID < ^uint8(0) {
+		coordinator.nextItemProducer = producer.ID + 1
+	}
+}
+
 func (coordinator *Coordinator) RemoveConsumerById(id interface{}, reason Event) error {
 	consumer, err := coordinator.GetConsumerById(id)
 	if err != nil {
@@ -73,6 +92,10 @@ func (coordinator *Coordinator) RemoveConsumerById(id interface{}, reason Event)
 	}
 	reason.StreamName = consumer.GetStreamName()
 	reason.Name = consumer.GetName()
+	if coordinator.notify != nil {
+		coordinator.notify(LifecycleEvent{Type: EventConsumerRemoved, StreamName: reason.StreamName,
+			Name: reason.Name, Reason: reason.Reason, Err: reason.Err})
+	}
 
 	if consumer.closeHandler != nil {
 		consumer.closeHandler <- reason
@@ -87,6 +110,10 @@ func (coordinator *Coordinator) RemoveProducerById(id uint8, reason Event) error
 	}
 	reason.StreamName = producer.GetStreamName()
 	reason.Name = producer.GetName()
+	if coordinator.notify != nil {
+		coordinator.notify(LifecycleEvent{Type: EventProducerRemoved, StreamName: reason.StreamName,
+			Name: reason.Name, Reason: reason.Reason, Err: reason.Err})
+	}
 	tentatives := 0
 	for producer.lenUnConfirmed() > 0 && tentatives < 3 {
 		time.Sleep(500 * time.Millisecond)
@@ -123,7 +150,7 @@ func newResponse(commandDescription string) *Response {
 	res.commandDescription = commandDescription
 	res.code = make(chan Code, 1)
 	res.data = make(chan interface{})
-	res.messages = make(chan []*amqp.Message, 100)
+	res.messages = make(chan []offsetMessage, 100)
 	return res
 }
 
@@ -148,6 +175,10 @@ func (coordinator *Coordinator) NewResponse(commandId uint16, info ...string) *R
 	coordinator.counter++
 	res := newResponse(description)
 	res.correlationid = coordinator.counter
+	res.commandId = commandId
+	if len(info) > 0 && commandTargetsStream(commandId) {
+		res.streamName = info[0]
+	}
 	coordinator.responses[strconv.Itoa(coordinator.counter)] = res
 	return res
 }
@@ -286,6 +317,28 @@ func (coordinator *Coordinator) reuseFreeId(refMap map[interface{}]interface{})
 	return result, nil
 }
 
+// producersList is a snapshot of the producers, safe to iterate
+func (coordinator *Coordinator) producersList() []*Producer {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	var res []*Producer
+	for _, producer := range coordinator.producers {
+		res = append(res, producer.(*Producer))
+	}
+	return res
+}
+
+// consumersList is a snapshot of the consumers, safe to iterate
+func (coordinator *Coordinator) consumersList() []*Consumer {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	var res []*Consumer
+	for _, consumer := range coordinator.consumers {
+		res = append(res, consumer.(*Consumer))
+	}
+	return res
+}
+
 func (coordinator *Coordinator) Producers() map[interface{}]interface{} {
 	coordinator.mutex.Lock()
 	defer coordinator.mutex.Unlock()
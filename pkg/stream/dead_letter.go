@@ -0,0 +1,255 @@
+package stream
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+)
+
+// the annotations of the dead-lettered messages
+const (
+	DeadLetterSourceStream = "x-dead-letter-source-stream"
+	DeadLetterSourceOffset = "x-dead-letter-source-offset"
+	DeadLetterConsumer     = "x-dead-letter-consumer"
+	DeadLetterError        = "x-dead-letter-error"
+	DeadLetterAttempts     = "x-dead-letter-attempts"
+)
+
+// ErrorMessagesHandler is a MessagesHandler that can fail,
+// see Environment.NewDeadLetterConsumer
+type ErrorMessagesHandler func(consumerContext ConsumerContext, message *amqp.Message) error
+
+// DeadLetterFailureHandler receives a message, with the DeadLetter
+// annotations, that can't be published to the dead-letter stream
+type DeadLetterFailureHandler func(message *amqp.Message, err error)
+
+type DeadLetterOptions struct {
+	// Stream receives the messages that the handler can't process,
+	// it must exist
+	Stream string
+	// Backoff is the delay between the attempts of a failed message,
+	// the message is dead-lettered when it returns false.
+	// 3 attempts, from 100ms, by default.
+	Backoff BackoffPolicy
+	// OnFailure is called when a message can't be published to the
+	// dead-letter stream or is not confirmed. When nil the consumer
+	// is closed, so no message is skipped without a trace.
+	OnFailure DeadLetterFailureHandler
+}
+
+func NewDeadLetterOptions(stream string) *DeadLetterOptions {
+	return &DeadLetterOptions{
+		Stream: stream,
+		Backoff: NewExponentialBackoff().
+			SetInitialDelay(defaultDeadLetterInitialDelay).
+			SetMaxAttempts(defaultDeadLetterAttempts),
+	}
+}
+
+func (d *DeadLetterOptions) SetBackoff(backoff BackoffPolicy) *DeadLetterOptions {
+	d.Backoff = backoff
+	return d
+}
+
+func (d *DeadLetterOptions) SetOnFailure(onFailure DeadLetterFailureHandler) *DeadLetterOptions {
+	d.OnFailure = onFailure
+	return d
+}
+
+// NewDeadLetterConsumer is NewConsumer with a handler that can fail.
+// A failed or panicking message is attempted again following
+// DeadLetterOptions.Backoff, then it is published to the dead-letter
+// stream with the DeadLetter annotations and the consumer goes on with
+// the next message. The dead-letter producer closes with the consumer.
+// A message that can't be dead-lettered goes to DeadLetterOptions.OnFailure.
+func (env *Environment) NewDeadLetterConsumer(streamName string,
+	handler ErrorMessagesHandler,
+	options *ConsumerOptions,
+	deadLetter *DeadLetterOptions) (*Consumer, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("the consumer needs a handler")
+	}
+	if deadLetter == nil || deadLetter.Stream == "" {
+		return nil, fmt.Errorf("the consumer needs the dead-letter Stream")
+	}
+	if deadLetter.Stream == streamName {
+		return nil, fmt.Errorf("the dead-letter Stream can't be the consumed stream")
+	}
+	backoff := deadLetter.Backoff
+	if backoff == nil {
+		backoff = NewDeadLetterOptions(deadLetter.Stream).Backoff
+	}
+
+	producer, err := env.NewProducer(deadLetter.Stream, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &deadLetterHandler{
+		handler:   handler,
+		backoff:   backoff,
+		stream:    deadLetter.Stream,
+		onFailure: deadLetter.OnFailure,
+		mutex:     &sync.Mutex{},
+		published: map[*amqp.AMQP10]*amqp.Message{},
+	}
+	d.publish = func(message *amqp.Message) error {
+		streamMessage := amqp.FromMessage(message)
+		d.mutex.Lock()
+		d.published[streamMessage] = message
+		d.mutex.Unlock()
+		if err := producer.Send(streamMessage); err != nil {
+			d.mutex.Lock()
+			delete(d.published, streamMessage)
+			d.mutex.Unlock()
+			return err
+		}
+		return nil
+	}
+	go d.handleConfirms(producer.NotifyPublishConfirmation())
+
+	consumer, err := env.NewConsumer(streamName, d.handle, options)
+	if err != nil {
+		_ = producer.Close()
+		return nil, err
+	}
+	d.setConsumer(consumer)
+	onClose := consumer.onClose
+	consumer.onClose = func(ch <-chan uint8) {
+		if onClose != nil {
+			onClose(ch)
+		}
+		if err := producer.Close(); err != nil && err != AlreadyClosed {
+			logs.LogWarn("dead-letter stream: %s, can't close the producer: %s",
+				deadLetter.Stream, err)
+		}
+	}
+	return consumer, nil
+}
+
+type deadLetterHandler struct {
+	handler   ErrorMessagesHandler
+	backoff   BackoffPolicy
+	publish   func(message *amqp.Message) error
+	stream    string
+	onFailure DeadLetterFailureHandler
+
+	mutex *sync.Mutex
+	// the dead-letter messages waiting for a confirmation
+	published map[*amqp.AMQP10]*amqp.Message
+	consumer  *Consumer
+	// a failure before setConsumer, the consumer is closed once set
+	failedEarly bool
+}
+
+func (d *deadLetterHandler) handle(consumerContext ConsumerContext, message *amqp.Message) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := d.attempt(consumerContext, message)
+		if err == nil {
+			return
+		}
+		delay, retry := d.backoff.NextDelay(attempt, time.Since(start))
+		if !retry {
+			d.deadLetter(consumerContext, message, err, attempt)
+			return
+		}
+		time.Sleep(delay)
+		if consumerContext.Consumer != nil && consumerContext.Consumer.getStatus() == closed {
+			// not handled and not dead-lettered. The offset of the consumer
+			// is already past the chunk, a StoreOffset skips this message
+			return
+		}
+	}
+}
+
+// attempt calls the handler, a panic is returned as an error
+func (d *deadLetterHandler) attempt(consumerContext ConsumerContext, message *amqp.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return d.handler(consumerContext, message)
+}
+
+func (d *deadLetterHandler) deadLetter(consumerContext ConsumerContext, message *amqp.Message,
+	cause error, attempts int) {
+	// the delivered message is not changed
+	failed := *message
+	failed.Annotations = amqp.Annotations{}
+	for key, value := range message.Annotations {
+		failed.Annotations[key] = value
+	}
+	failed.Annotations[DeadLetterSourceStream] = consumerContext.Message.StreamName
+	failed.Annotations[DeadLetterSourceOffset] = consumerContext.Message.Offset
+	failed.Annotations[DeadLetterError] = cause.Error()
+	failed.Annotations[DeadLetterAttempts] = int64(attempts)
+	if consumerContext.Consumer != nil && consumerContext.Consumer.GetName() != "" {
+		failed.Annotations[DeadLetterConsumer] = consumerContext.Consumer.GetName()
+	}
+
+	if err := d.publish(&failed); err != nil {
+		d.failed(&failed, err)
+		return
+	}
+	logs.LogDebug("stream: %s, offset: %d, message dead-lettered after %d attempts: %s",
+		consumerContext.Message.StreamName, consumerContext.Message.Offset, attempts, cause)
+}
+
+func (d *deadLetterHandler) handleConfirms(confirms ChannelPublishConfirm) {
+	for messages := range confirms {
+		for _, msg := range messages {
+			streamMessage, _ := msg.Message.(*amqp.AMQP10)
+			d.mutex.Lock()
+			message := d.published[streamMessage]
+			delete(d.published, streamMessage)
+			d.mutex.Unlock()
+			if msg.Confirmed || message == nil {
+				continue
+			}
+			err := msg.Err
+			if err == nil {
+				err = fmt.Errorf("message not confirmed")
+			}
+			d.failed(message, err)
+		}
+	}
+}
+
+// failed passes the message to onFailure, or closes the consumer
+func (d *deadLetterHandler) failed(message *amqp.Message, err error) {
+	logs.LogWarn("dead-letter stream: %s, source offset: %v, can't dead-letter the message: %s",
+		d.stream, message.Annotations[DeadLetterSourceOffset], err)
+	if d.onFailure != nil {
+		d.onFailure(message, err)
+		return
+	}
+	d.mutex.Lock()
+	consumer := d.consumer
+	if consumer == nil {
+		d.failedEarly = true
+	}
+	d.mutex.Unlock()
+	if consumer != nil {
+		go d.closeConsumer(consumer)
+	}
+}
+
+func (d *deadLetterHandler) setConsumer(consumer *Consumer) {
+	d.mutex.Lock()
+	d.consumer = consumer
+	failedEarly := d.failedEarly
+	d.mutex.Unlock()
+	if failedEarly {
+		go d.closeConsumer(consumer)
+	}
+}
+
+func (d *deadLetterHandler) closeConsumer(consumer *Consumer) {
+	if err := consumer.Close(); err != nil && err != AlreadyClosed {
+		logs.LogWarn("dead-letter stream: %s, can't close the consumer: %s", d.stream, err)
+	}
+}
@@ -0,0 +1,232 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
+
+func newTestMessage() *amqp.Message {
+	return &amqp.Message{Data: [][]byte{[]byte("hello")}}
+}
+
+var _ = Describe("Dead letter", func() {
+
+	var (
+		published []*amqp.Message
+		handler   *deadLetterHandler
+		context   ConsumerContext
+	)
+	newHandler := func(h ErrorMessagesHandler) *deadLetterHandler {
+		return &deadLetterHandler{
+			handler: h,
+			backoff: NewExponentialBackoff().SetJitter(0).
+				SetInitialDelay(time.Millisecond).SetMaxAttempts(3),
+			publish: func(message *amqp.Message) error {
+				published = append(published, message)
+				return nil
+			},
+			mutex:     &sync.Mutex{},
+			published: map[*amqp.AMQP10]*amqp.Message{},
+		}
+	}
+	failing := func(consumerContext ConsumerContext, message *amqp.Message) error {
+		return errors.New("failed")
+	}
+	BeforeEach(func() {
+		published = nil
+		context = ConsumerContext{Message: MessageContext{StreamName: "source", Offset: 42}}
+	})
+
+	It("Retries and succeeds", func() {
+		attempts := 0
+		handler = newHandler(func(consumerContext ConsumerContext, message *amqp.Message) error {
+			attempts++
+			if attempts < 2 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+		handler.handle(context, newTestMessage())
+		Expect(attempts).To(Equal(2))
+		Expect(published).To(BeEmpty())
+	})
+
+	It("Dead-letters after the attempts", func() {
+		attempts := 0
+		handler = newHandler(func(consumerContext ConsumerContext, message *amqp.Message) error {
+			attempts++
+			return errors.New("failed")
+		})
+		original := newTestMessage()
+		original.Annotations = amqp.Annotations{"key": "value"}
+		handler.handle(context, original)
+		Expect(attempts).To(Equal(3))
+		Expect(published).To(HaveLen(1))
+		Expect(published[0].GetData()).To(Equal([]byte("hello")))
+		Expect(published[0].Annotations).To(HaveKeyWithValue("key", "value"))
+		Expect(published[0].Annotations).To(HaveKeyWithValue(DeadLetterSourceStream, "source"))
+		Expect(published[0].Annotations).To(HaveKeyWithValue(DeadLetterSourceOffset, int64(42)))
+		Expect(published[0].Annotations).To(HaveKeyWithValue(DeadLetterError, "failed"))
+		Expect(published[0].Annotations).To(HaveKeyWithValue(DeadLetterAttempts, int64(3)))
+		Expect(original.Annotations).To(HaveLen(1))
+	})
+
+	It("A panic is an error", func() {
+		handler = newHandler(func(consumerContext ConsumerContext, message *amqp.Message) error {
+			panic("boom")
+		})
+		Expect(func() {
+			handler.handle(context, newTestMessage())
+		}).NotTo(Panic())
+		Expect(published).To(HaveLen(1))
+		Expect(published[0].Annotations).To(HaveKeyWithValue(DeadLetterError, "handler panic: boom"))
+	})
+
+	It("A failed dead-letter publish goes to OnFailure", func() {
+		var failures []error
+		handler = newHandler(failing)
+		handler.publish = func(message *amqp.Message) error {
+			return errors.New("publish failed")
+		}
+		handler.onFailure = func(message *amqp.Message, err error) {
+			Expect(message.Annotations).To(HaveKeyWithValue(DeadLetterSourceOffset, int64(42)))
+			failures = append(failures, err)
+		}
+		handler.handle(context, newTestMessage())
+		Expect(failures).To(HaveLen(1))
+		Expect(failures[0]).To(MatchError("publish failed"))
+	})
+
+	It("An unconfirmed dead-letter message goes to OnFailure", func() {
+		var failed []*amqp.Message
+		handler = newHandler(failing)
+		handler.onFailure = func(message *amqp.Message, err error) {
+			Expect(err).To(MatchError(ConfirmationTimeout))
+			failed = append(failed, message)
+		}
+		confirmed, unconfirmed := newTestMessage(), newTestMessage()
+		confirmedStream, unconfirmedStream := amqp.FromMessage(confirmed), amqp.FromMessage(unconfirmed)
+		handler.published[confirmedStream] = confirmed
+		handler.published[unconfirmedStream] = unconfirmed
+
+		confirms := make(chan []*UnConfirmedMessage, 1)
+		confirms <- []*UnConfirmedMessage{
+			{Message: confirmedStream, Confirmed: true},
+			{Message: unconfirmedStream, Err: ConfirmationTimeout},
+		}
+		close(confirms)
+		handler.handleConfirms(confirms)
+		Expect(failed).To(HaveLen(1))
+		Expect(failed[0]).To(BeIdenticalTo(unconfirmed))
+		Expect(handler.published).To(BeEmpty())
+	})
+
+	It("Without OnFailure the consumer is closed", func() {
+		handler = newHandler(failing)
+		handler.publish = func(message *amqp.Message) error {
+			return errors.New("publish failed")
+		}
+		// the consumer is not set yet
+		handler.handle(context, newTestMessage())
+		Expect(handler.failedEarly).To(BeTrue())
+	})
+
+	It("A MessagesHandler panic doesn't stop the delivery", func() {
+		consumer := &Consumer{
+			options: NewConsumerOptions(),
+			MessagesHandler: func(consumerContext ConsumerContext, message *amqp.Message) {
+				panic("boom")
+			},
+		}
+		Expect(func() {
+			consumer.handleMessage(context, newTestMessage())
+		}).NotTo(Panic())
+	})
+
+	It("Validates the options", func() {
+		env, err := NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer env.Close()
+		noop := func(consumerContext ConsumerContext, message *amqp.Message) error { return nil }
+		_, err = env.NewDeadLetterConsumer("stream", noop, nil, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = env.NewDeadLetterConsumer("stream", noop, nil, NewDeadLetterOptions("stream"))
+		Expect(err).To(HaveOccurred())
+		_, err = env.NewDeadLetterConsumer("stream", nil, nil, NewDeadLetterOptions("dlq"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Keeps the caller's options", func() {
+		env, err := NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		streamName := uuid.New().String()
+		deadLetterStream := uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+		Expect(env.DeclareStream(deadLetterStream, nil)).NotTo(HaveOccurred())
+
+		deadLetter := &DeadLetterOptions{Stream: deadLetterStream}
+		consumer, err := env.NewDeadLetterConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) error { return nil },
+			nil, deadLetter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deadLetter.Backoff).To(BeNil())
+
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.DeleteStream(deadLetterStream)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+	})
+
+	It("Publishes the failed messages to the dead-letter stream", func() {
+		env, err := NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		streamName := uuid.New().String()
+		deadLetterStream := uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+		Expect(env.DeclareStream(deadLetterStream, nil)).NotTo(HaveOccurred())
+
+		producer, err := env.NewProducer(streamName, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.BatchSend(CreateArrayMessagesForTesting(10))).NotTo(HaveOccurred())
+		Expect(producer.Close()).NotTo(HaveOccurred())
+
+		var handled int32
+		consumer, err := env.NewDeadLetterConsumer(streamName,
+			func(consumerContext ConsumerContext, message *amqp.Message) error {
+				if consumerContext.Message.Offset%2 == 0 {
+					return errors.New("even offset")
+				}
+				atomic.AddInt32(&handled, 1)
+				return nil
+			}, NewConsumerOptions().SetOffset(OffsetSpecification{}.First()),
+			NewDeadLetterOptions(deadLetterStream).SetBackoff(
+				NewExponentialBackoff().SetInitialDelay(time.Millisecond).SetMaxAttempts(2)))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&handled)
+		}, 5*time.Second).Should(Equal(int32(5)))
+
+		var deadLettered int32
+		deadLetterConsumer, err := env.NewConsumer(deadLetterStream,
+			func(consumerContext ConsumerContext, message *amqp.Message) {
+				atomic.AddInt32(&deadLettered, 1)
+			}, NewConsumerOptions().SetOffset(OffsetSpecification{}.First()))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&deadLettered)
+		}, 5*time.Second).Should(Equal(int32(5)))
+
+		Expect(deadLetterConsumer.Close()).NotTo(HaveOccurred())
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.DeleteStream(deadLetterStream)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+	})
+})
@@ -1,33 +1,33 @@
 package stream
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
 )
 
 type Environment struct {
-	producers *producersEnvironment
-	consumers *consumersEnvironment
-	options   *EnvironmentOptions
+	producers  *producersEnvironment
+	consumers  *consumersEnvironment
+	options    *EnvironmentOptions
+	serverInfo *ServerInfo
+	// the locator connection is shared by the admin calls and
+	// by the lookups of producers and consumers
+	locator      *Client
+	locatorMutex *sync.Mutex
+	events       *eventBus
 }
 
 func NewEnvironment(options *EnvironmentOptions) (*Environment, error) {
-	client := newClient("go-stream-locator", nil)
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
 	if options == nil {
 		options = NewEnvironmentOptions()
 	}
@@ -37,9 +37,36 @@ func NewEnvironment(options *EnvironmentOptions) (*Environment, error) {
 		return nil, fmt.Errorf(" MaxConsumersPerClient and MaxProducersPerClient must be between 1 and 254")
 	}
 
+	if options.RequestedMaxFrameSize == 0 {
+		options.RequestedMaxFrameSize = defaultRequestedMaxFrameSize
+	}
+	if options.RequestedMaxFrameSize < minRequestedMaxFrameSize {
+		return nil, fmt.Errorf("RequestedMaxFrameSize must be at least %d", minRequestedMaxFrameSize)
+	}
+
+	if options.RequestedHeartbeat == 0 {
+		options.RequestedHeartbeat = defaultRequestedHeartbeat
+	}
+	if options.RequestedHeartbeat != NoHeartbeat && options.RequestedHeartbeat < time.Second {
+		return nil, fmt.Errorf("RequestedHeartbeat must be NoHeartbeat or at least 1 second")
+	}
+
+	if options.BackoffPolicy == nil {
+		options.BackoffPolicy = NewExponentialBackoff()
+	}
+
+	if options.ProducerMultiplexing == nil {
+		options.ProducerMultiplexing = NewFillFirstStrategy()
+	}
+
+	if options.ConsumerMultiplexing == nil {
+		options.ConsumerMultiplexing = NewFillFirstStrategy()
+	}
+
 	if len(options.ConnectionParameters) == 0 {
 		options.ConnectionParameters = []*Broker{newBrokerDefault()}
 	}
+	client := newEnvironmentClient(connectionKindLocator, nil, options, "", 0)
 
 	for _, parameter := range options.ConnectionParameters {
 
@@ -66,55 +93,117 @@ func NewEnvironment(options *EnvironmentOptions) (*Environment, error) {
 
 		client.broker = parameter
 	}
-	return &Environment{
-		options:   options,
-		producers: newProducers(options.MaxProducersPerClient),
-		consumers: newConsumerEnvironment(options.MaxConsumersPerClient),
-	}, client.connect()
+	events := newEventBus()
+	client.setEvents(events)
+	err := client.connect()
+	if err != nil {
+		_ = client.Close()
+	}
+	env := &Environment{
+		options:      options,
+		producers:    newProducers(options, events),
+		consumers:    newConsumerEnvironment(options, events),
+		serverInfo:   client.ServerInfo(),
+		locator:      client,
+		locatorMutex: &sync.Mutex{},
+		events:       events,
+	}
+	env.producers.locator = env.getLocator
+	return env, err
 }
-func (env *Environment) newReconnectClient() (*Client, error) {
-	broker := &env.options.ConnectionParameters[0]
-	client := newClient("go-stream-locator", *broker)
 
-	err := client.connect()
-	tentatives := 1
-	for err != nil {
-		logs.LogError("Can't connect the locator client, error:%s, retry in %d seconds, broker: ", err, tentatives,
-			client.broker)
-		time.Sleep(time.Duration(tentatives) * time.Second)
-		rand.Seed(time.Now().UnixNano())
-		n := rand.Intn(len(env.options.ConnectionParameters))
-		client = newClient("stream-locator", env.options.ConnectionParameters[n])
-		tentatives = tentatives + 1
-		err = client.connect()
+// getLocator returns the locator connection, it is created again
+// when the connection is closed, for example by a missing heartbeat
+func (env *Environment) getLocator() (*Client, error) {
+	env.locatorMutex.Lock()
+	defer env.locatorMutex.Unlock()
+	if env.locator != nil && env.locator.socket.isOpen() {
+		return env.locator, nil
+	}
+	client, err := env.newReconnectClient()
+	if err != nil {
+		return nil, err
+	}
+	env.locator = client
+	return client, nil
+}
 
+func (env *Environment) closeLocator() {
+	env.locatorMutex.Lock()
+	defer env.locatorMutex.Unlock()
+	if env.locator != nil {
+		_ = env.locator.Close()
+		env.locator = nil
+	}
+}
+func (env *Environment) newReconnectClient() (*Client, error) {
+	broker := env.options.ConnectionParameters[0]
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		client := newEnvironmentClient(connectionKindLocator, broker, env.options, "", attempt)
+		client.setEvents(env.events)
+		err := client.connect()
+		if err == nil {
+			return client, nil
+		}
+		_ = client.Close()
+		env.events.publish(LifecycleEvent{Type: EventReconnectAttempt, Broker: broker.hostPort(),
+			Attempt: attempt, Err: err})
+
+		delay, retry := env.options.BackoffPolicy.NextDelay(attempt, time.Since(start))
+		if !retry {
+			logs.LogError("Can't connect the locator client after %d attempts, error:%s", attempt, err)
+			return nil, fmt.Errorf("can't connect the locator client after %d attempts: %w", attempt, err)
+		}
+		logs.LogError("Can't connect the locator client, error:%s, retry in %s, broker: %s", err, delay,
+			broker.hostPort())
+		time.Sleep(delay)
+		broker = env.options.ConnectionParameters[randomIntn(len(env.options.ConnectionParameters))]
 	}
+}
 
-	return client, client.connect()
+// BackoffPolicy is the policy used by the reconnections
+func (env *Environment) BackoffPolicy() BackoffPolicy {
+	return env.options.BackoffPolicy
 }
 
 func (env *Environment) DeclareStream(streamName string, options *StreamOptions) error {
-	client, err := env.newReconnectClient()
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
+	client, err := env.getLocator()
 	if err != nil {
 		return err
 	}
 	return client.DeclareStream(streamName, options)
 }
 
+// EnsureStream declares the stream if it doesn't exist.
+// An existing stream with the same options is not an error,
+// with different options a *StreamOptionsMismatch is returned
+func (env *Environment) EnsureStream(streamName string, options *StreamOptions) error {
+	client, err := env.getLocator()
+	if err != nil {
+		return err
+	}
+	if options == nil {
+		options = NewStreamOptions()
+	}
+
+	err = client.DeclareStream(streamName, options)
+	switch {
+	case err == nil, errors.Is(err, StreamAlreadyExists):
+		return nil
+	case errors.Is(err, PreconditionFailed):
+		return client.streamOptionsMismatch(streamName, options)
+	}
+	return err
+}
+
+// DeclareStreamIfNotExists is an alias of EnsureStream
+func (env *Environment) DeclareStreamIfNotExists(streamName string, options *StreamOptions) error {
+	return env.EnsureStream(streamName, options)
+}
+
 func (env *Environment) DeleteStream(streamName string) error {
-	client, err := env.newReconnectClient()
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
+	client, err := env.getLocator()
 	if err != nil {
 		return err
 	}
@@ -122,13 +211,7 @@ func (env *Environment) DeleteStream(streamName string) error {
 }
 
 func (env *Environment) NewProducer(streamName string, producerOptions *ProducerOptions) (*Producer, error) {
-	client, err := env.newReconnectClient()
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
+	client, err := env.getLocator()
 	if err != nil {
 		return nil, err
 	}
@@ -137,27 +220,25 @@ func (env *Environment) NewProducer(streamName string, producerOptions *Producer
 }
 
 func (env *Environment) StreamExists(streamName string) (bool, error) {
-	client, err := env.newReconnectClient()
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
+	client, err := env.getLocator()
 	if err != nil {
 		return false, err
 	}
 	return client.StreamExists(streamName), nil
 }
 
+// StreamStats returns the statistics of the stream, it needs
+// a server with FeatureStreamStats
+func (env *Environment) StreamStats(streamName string) (*StreamStats, error) {
+	client, err := env.getLocator()
+	if err != nil {
+		return nil, err
+	}
+	return client.StreamStats(streamName)
+}
+
 func (env *Environment) StreamMetaData(streamName string) (*StreamMetadata, error) {
-	client, err := env.newReconnectClient()
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
+	client, err := env.getLocator()
 	if err != nil {
 		return nil, err
 	}
@@ -183,13 +264,7 @@ func (env *Environment) StreamMetaData(streamName string) (*StreamMetadata, erro
 func (env *Environment) NewConsumer(streamName string,
 	messagesHandler MessagesHandler,
 	options *ConsumerOptions) (*Consumer, error) {
-	client, err := env.newReconnectClient()
-	defer func(client *Client) {
-		err := client.Close()
-		if err != nil {
-			return
-		}
-	}(client)
+	client, err := env.getLocator()
 	if err != nil {
 		return nil, err
 	}
@@ -197,16 +272,109 @@ func (env *Environment) NewConsumer(streamName string,
 	return env.consumers.NewSubscriber(client, streamName, messagesHandler, options)
 }
 
+// ServerInfo describes the server the environment connected to
+// when it was created
+func (env *Environment) ServerInfo() *ServerInfo {
+	return env.serverInfo
+}
+
+// Shutdown closes the environment gracefully, within the context deadline:
+// the producers stop accepting messages, send the queued ones and wait
+// for the confirmations; the consumers finish the messages already
+// received and store the offset. Then the connections are closed.
+// The first error is returned, the context error when the deadline
+// expired before the drain completed.
+func (env *Environment) Shutdown(ctx context.Context) error {
+	var producers []*Producer
+	for _, coordinator := range env.producers.getCoordinators() {
+		producers = append(producers, coordinator.producers()...)
+	}
+	var consumers []*Consumer
+	for _, coordinator := range env.consumers.getCoordinators() {
+		consumers = append(consumers, coordinator.consumers()...)
+	}
+
+	var mutex sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil && err != nil && err != AlreadyClosed {
+			firstErr = err
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, producer := range producers {
+		wg.Add(1)
+		go func(producer *Producer) {
+			defer wg.Done()
+			setErr(producer.drain(ctx))
+		}(producer)
+	}
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func(consumer *Consumer) {
+			defer wg.Done()
+			setErr(consumer.drain(ctx))
+		}(consumer)
+	}
+	wg.Wait()
+
+	_ = env.Close()
+	return firstErr
+}
+
 func (env *Environment) Close() error {
 	_ = env.producers.close()
 	_ = env.consumers.close()
+	env.closeLocator()
+	env.events.close()
 	return nil
 }
 
+// Events subscribes to the lifecycle events of the connections,
+// producers and consumers of the environment. Each call returns a new
+// subscription; the events are dropped when the channel is full, so a
+// slow listener doesn't block the client.
+// unsubscribe and Close close the channel.
+func (env *Environment) Events() (events <-chan LifecycleEvent, unsubscribe func()) {
+	return env.events.subscribe()
+}
+
 type EnvironmentOptions struct {
 	ConnectionParameters  []*Broker
 	MaxProducersPerClient int
 	MaxConsumersPerClient int
+	// ApplicationName is sent as client property and used
+	// in the default connection names
+	ApplicationName string
+	// ClientProperties are sent to the server with the peer properties
+	// and are visible in the management UI
+	ClientProperties map[string]string
+	// ProducerConnectionName and ConsumerConnectionName are the templates
+	// of the connection names, see the ConnectionName placeholders
+	ProducerConnectionName string
+	ConsumerConnectionName string
+	// RequestedMaxFrameSize and RequestedHeartbeat are negotiated with
+	// the server during the connection, the lower values win.
+	// Zero means the default, NoHeartbeat disables the heartbeat
+	// if the server agrees.
+	RequestedMaxFrameSize int
+	RequestedHeartbeat    time.Duration
+	// AddressResolver maps the nodes returned by the stream metadata
+	// to dialable addresses, see AddressResolver
+	AddressResolver AddressResolver
+	// BackoffPolicy is used by all the reconnections,
+	// the error is returned when it gives up
+	BackoffPolicy BackoffPolicy
+	// ConsumerPlacementPolicy chooses the node of the consumer connections,
+	// PlacementRandom when nil
+	ConsumerPlacementPolicy ConsumerPlacementPolicy
+	// ProducerMultiplexing and ConsumerMultiplexing choose the connection
+	// of the new producers and consumers, see MultiplexingStrategy
+	ProducerMultiplexing MultiplexingStrategy
+	ConsumerMultiplexing MultiplexingStrategy
 }
 
 func NewEnvironmentOptions() *EnvironmentOptions {
@@ -214,6 +382,11 @@ func NewEnvironmentOptions() *EnvironmentOptions {
 		MaxProducersPerClient: 1,
 		MaxConsumersPerClient: 1,
 		ConnectionParameters:  []*Broker{},
+		RequestedMaxFrameSize: defaultRequestedMaxFrameSize,
+		RequestedHeartbeat:    defaultRequestedHeartbeat,
+		BackoffPolicy:         NewExponentialBackoff(),
+		ProducerMultiplexing:  NewFillFirstStrategy(),
+		ConsumerMultiplexing:  NewFillFirstStrategy(),
 	}
 }
 
@@ -227,6 +400,64 @@ func (envOptions *EnvironmentOptions) SetMaxConsumersPerClient(maxConsumersPerCl
 	return envOptions
 }
 
+func (envOptions *EnvironmentOptions) SetRequestedMaxFrameSize(requestedMaxFrameSize int) *EnvironmentOptions {
+	envOptions.RequestedMaxFrameSize = requestedMaxFrameSize
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetRequestedHeartbeat(requestedHeartbeat time.Duration) *EnvironmentOptions {
+	envOptions.RequestedHeartbeat = requestedHeartbeat
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetAddressResolver(addressResolver AddressResolver) *EnvironmentOptions {
+	envOptions.AddressResolver = addressResolver
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetBackoffPolicy(backoffPolicy BackoffPolicy) *EnvironmentOptions {
+	envOptions.BackoffPolicy = backoffPolicy
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetConsumerPlacementPolicy(placementPolicy ConsumerPlacementPolicy) *EnvironmentOptions {
+	envOptions.ConsumerPlacementPolicy = placementPolicy
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetProducerMultiplexing(strategy MultiplexingStrategy) *EnvironmentOptions {
+	envOptions.ProducerMultiplexing = strategy
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetConsumerMultiplexing(strategy MultiplexingStrategy) *EnvironmentOptions {
+	envOptions.ConsumerMultiplexing = strategy
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetApplicationName(applicationName string) *EnvironmentOptions {
+	envOptions.ApplicationName = applicationName
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetClientProperty(key string, value string) *EnvironmentOptions {
+	if envOptions.ClientProperties == nil {
+		envOptions.ClientProperties = map[string]string{}
+	}
+	envOptions.ClientProperties[key] = value
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetProducerConnectionName(template string) *EnvironmentOptions {
+	envOptions.ProducerConnectionName = template
+	return envOptions
+}
+
+func (envOptions *EnvironmentOptions) SetConsumerConnectionName(template string) *EnvironmentOptions {
+	envOptions.ConsumerConnectionName = template
+	return envOptions
+}
+
 func (envOptions *EnvironmentOptions) SetUri(uri string) *EnvironmentOptions {
 	if len(envOptions.ConnectionParameters) == 0 {
 		envOptions.ConnectionParameters = append(envOptions.ConnectionParameters, &Broker{Uri: uri})
@@ -314,6 +545,11 @@ type environmentCoordinator struct {
 	clientsPerContext map[int]*Client
 	maxItemsForClient int
 	nextId            int
+	options           *EnvironmentOptions
+	events            *eventBus
+	// onMetadataUpdate handles the metadata updates of the producer
+	// connections, nil to remove the producers of the stream
+	onMetadataUpdate func(client *Client, streamName string)
 }
 
 func (cc *environmentCoordinator) isProducerListFull(clientsPerContextId int) bool {
@@ -321,9 +557,20 @@ func (cc *environmentCoordinator) isProducerListFull(clientsPerContextId int) bo
 		ProducersCount() >= cc.maxItemsForClient
 }
 
-func (cc *environmentCoordinator) isConsumerListFull(clientsPerContextId int) bool {
-	return cc.clientsPerContext[clientsPerContextId].coordinator.
-		ConsumersCount() >= cc.maxItemsForClient
+// clientWithFreeProducerId returns a shared client where the producer
+// ID is free, it must be called with cc.mutex held
+func (cc *environmentCoordinator) clientWithFreeProducerId(id uint8) *Client {
+	cc.mutexContext.RLock()
+	defer cc.mutexContext.RUnlock()
+	for i, client := range cc.clientsPerContext {
+		if client.dedicated || client.emptying || cc.isProducerListFull(i) || !client.socket.isOpen() {
+			continue
+		}
+		if _, err := client.coordinator.GetProducerById(id); err != nil {
+			return client
+		}
+	}
+	return nil
 }
 
 func (cc *environmentCoordinator) maybeCleanClients() {
@@ -388,35 +635,56 @@ func (client *Client) maybeCleanConsumers(streamName string) {
 	}
 }
 
+// newConnectedClient connects a new client to the broker. When the broker
+// address is resolved the connection can land on another node, for example
+// behind a load balancer, in this case the client tries a new connection.
+// It must be called with cc.mutex held, the mutex is released while
+// waiting for the next attempt.
+func (cc *environmentCoordinator) newConnectedClient(kind string, broker *Broker,
+	streamName string) (*Client, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		client := newEnvironmentClient(kind, broker, cc.options, streamName, cc.nextId+1)
+		client.setEvents(cc.events)
+		err := client.connect()
+		if err == nil {
+			return client, nil
+		}
+		_ = client.Close()
+		if err != AdvertisedAddressMismatch {
+			return nil, err
+		}
+		cc.events.publish(LifecycleEvent{Type: EventReconnectAttempt, Broker: broker.hostPort(),
+			StreamName: streamName, Attempt: attempt, Reason: "advertised address mismatch", Err: err})
+		delay, retry := cc.options.BackoffPolicy.NextDelay(attempt, time.Since(start))
+		if !retry {
+			return nil, err
+		}
+		logs.LogDebug("%s, attempt %d, retry in %s", err, attempt, delay)
+		// the other clients of the coordinator don't wait for the backoff
+		cc.mutex.Unlock()
+		time.Sleep(delay)
+		cc.mutex.Lock()
+	}
+}
+
 func (cc *environmentCoordinator) newProducer(leader *Broker, streamName string,
 	options *ProducerOptions) (*Producer, error) {
 	cc.mutex.Lock()
 	defer cc.mutex.Unlock()
-	var clientResult *Client
-	for i, client := range cc.clientsPerContext {
-		if !cc.isProducerListFull(i) {
-			clientResult = client
-			break
-		}
+	var name string
+	if options != nil {
+		name = options.Name
 	}
+	clientResult, dedicated := cc.selectClient(cc.options.ProducerMultiplexing,
+		MultiplexedEntity{Kind: connectionKindProducer, StreamName: streamName, Name: name})
 
 	if clientResult == nil {
-		clientResult = newClient("go-stream-producer", leader)
-		chMeta := make(chan metaDataUpdateEvent, 1)
-		clientResult.metadataListener = chMeta
-		go func(ch <-chan metaDataUpdateEvent, cl *Client) {
-			for metaDataUpdateEvent := range ch {
-				clientResult.maybeCleanProducers(metaDataUpdateEvent.StreamName)
-				cc.maybeCleanClients()
-				if !cl.socket.isOpen() {
-					return
-				}
-			}
-
-		}(chMeta, clientResult)
-
-		cc.nextId++
-		cc.clientsPerContext[cc.nextId] = clientResult
+		var err error
+		clientResult, err = cc.newProducerClient(leader, streamName, dedicated)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	err := clientResult.connect()
@@ -433,21 +701,91 @@ func (cc *environmentCoordinator) newProducer(leader *Broker, streamName string,
 	return producer, nil
 }
 
+// newProducerClient connects a new client for the producers,
+// it must be called with cc.mutex held
+func (cc *environmentCoordinator) newProducerClient(leader *Broker, streamName string,
+	dedicated bool) (*Client, error) {
+	clientResult, err := cc.newConnectedClient(connectionKindProducer, leader, streamName)
+	if err != nil {
+		return nil, err
+	}
+	clientResult.dedicated = dedicated
+	chMeta := make(chan metaDataUpdateEvent, 1)
+	clientResult.metadataListener = chMeta
+	go func(ch <-chan metaDataUpdateEvent, cl *Client) {
+		for metaDataUpdateEvent := range ch {
+			if cc.onMetadataUpdate != nil {
+				// the migration can take a while, the
+				// reader of the connection must not wait
+				go cc.onMetadataUpdate(cl, metaDataUpdateEvent.StreamName)
+				continue
+			}
+			cl.maybeCleanProducers(metaDataUpdateEvent.StreamName)
+			cc.maybeCleanClients()
+			if !cl.socket.isOpen() {
+				return
+			}
+		}
+
+	}(chMeta, clientResult)
+
+	cc.nextId++
+	cc.clientsPerContext[cc.nextId] = clientResult
+	return clientResult, nil
+}
+
+// reuseProducer declares the existing producer on a client of
+// the coordinator where its ID is free, see Client.ReusePublisher
+func (cc *environmentCoordinator) reuseProducer(leader *Broker, producer *Producer) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	streamName := producer.GetStreamName()
+	clientResult, dedicated := cc.selectClient(cc.options.ProducerMultiplexing,
+		MultiplexedEntity{Kind: connectionKindProducer, StreamName: streamName, Name: producer.GetName()})
+	if clientResult != nil && !clientResult.socket.isOpen() {
+		clientResult = nil
+	}
+	if clientResult != nil {
+		if _, err := clientResult.coordinator.GetProducerById(producer.ID); err == nil {
+			// the ID is taken, the first shared client where it is free
+			clientResult = cc.clientWithFreeProducerId(producer.ID)
+		}
+	}
+
+	if clientResult == nil {
+		var err error
+		clientResult, err = cc.newProducerClient(leader, streamName, dedicated)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := clientResult.ReusePublisher(streamName, producer)
+	if err != nil {
+		_ = clientResult.coordinator.removeById(producer.ID, clientResult.coordinator.producers)
+	}
+	return err
+}
+
 func (cc *environmentCoordinator) newConsumer(leader *Broker,
 	streamName string, messagesHandler MessagesHandler,
 	options *ConsumerOptions) (*Consumer, error) {
 	cc.mutex.Lock()
 	defer cc.mutex.Unlock()
-	var clientResult *Client
-	for i, client := range cc.clientsPerContext {
-		if !cc.isConsumerListFull(i) {
-			clientResult = client
-			break
-		}
+	var name string
+	if options != nil {
+		name = options.ConsumerName
 	}
+	clientResult, dedicated := cc.selectClient(cc.options.ConsumerMultiplexing,
+		MultiplexedEntity{Kind: connectionKindConsumer, StreamName: streamName, Name: name})
 
 	if clientResult == nil {
-		clientResult = newClient("go-stream-consumer", leader)
+		var err error
+		clientResult, err = cc.newConnectedClient(connectionKindConsumer, leader, streamName)
+		if err != nil {
+			return nil, err
+		}
+		clientResult.dedicated = dedicated
 		chMeta := make(chan metaDataUpdateEvent)
 		clientResult.metadataListener = chMeta
 		go func(ch <-chan metaDataUpdateEvent, cl *Client) {
@@ -488,6 +826,26 @@ func (cc *environmentCoordinator) close() error {
 	return nil
 }
 
+func (cc *environmentCoordinator) producers() []*Producer {
+	cc.mutexContext.RLock()
+	defer cc.mutexContext.RUnlock()
+	var res []*Producer
+	for _, client := range cc.clientsPerContext {
+		res = append(res, client.coordinator.producersList()...)
+	}
+	return res
+}
+
+func (cc *environmentCoordinator) consumers() []*Consumer {
+	cc.mutexContext.RLock()
+	defer cc.mutexContext.RUnlock()
+	var res []*Consumer
+	for _, client := range cc.clientsPerContext {
+		res = append(res, client.coordinator.consumersList()...)
+	}
+	return res
+}
+
 func (cc *environmentCoordinator) getClientsPerContext() map[int]*Client {
 	cc.mutexContext.Lock()
 	defer cc.mutexContext.Unlock()
@@ -498,13 +856,19 @@ type producersEnvironment struct {
 	mutex                *sync.Mutex
 	producersCoordinator map[string]*environmentCoordinator
 	maxItemsForClient    int
+	options              *EnvironmentOptions
+	events               *eventBus
+	// locator looks up the new leader when the producers migrate
+	locator func() (*Client, error)
 }
 
-func newProducers(maxItemsForClient int) *producersEnvironment {
+func newProducers(options *EnvironmentOptions, events *eventBus) *producersEnvironment {
 	producers := &producersEnvironment{
 		mutex:                &sync.Mutex{},
 		producersCoordinator: map[string]*environmentCoordinator{},
-		maxItemsForClient:    maxItemsForClient,
+		maxItemsForClient:    options.MaxProducersPerClient,
+		options:              options,
+		events:               events,
 	}
 	return producers
 }
@@ -512,23 +876,18 @@ func newProducers(maxItemsForClient int) *producersEnvironment {
 func (ps *producersEnvironment) newProducer(clientLocator *Client, streamName string,
 	options *ProducerOptions) (*Producer, error) {
 	ps.mutex.Lock()
-	defer ps.mutex.Unlock()
 	leader, err := clientLocator.BrokerLeader(streamName)
 	if err != nil {
+		ps.mutex.Unlock()
 		return nil, err
 	}
-	if ps.producersCoordinator[leader.hostPort()] == nil {
-		ps.producersCoordinator[leader.hostPort()] = &environmentCoordinator{
-			clientsPerContext: map[int]*Client{},
-			mutex:             &sync.Mutex{},
-			maxItemsForClient: ps.maxItemsForClient,
-			mutexContext:      &sync.RWMutex{},
-			nextId:            0,
-		}
-	}
+	coordinator := ps.getCoordinator(leader)
+	// ps.mutex is not held during the connection backoff
+	ps.mutex.Unlock()
 	leader.cloneFrom(clientLocator.broker)
+	leader.resolveWith(ps.options.AddressResolver)
 
-	producer, err := ps.producersCoordinator[leader.hostPort()].newProducer(leader, streamName,
+	producer, err := coordinator.newProducer(leader, streamName,
 		options)
 	if err != nil {
 		return nil, err
@@ -536,12 +895,113 @@ func (ps *producersEnvironment) newProducer(clientLocator *Client, streamName st
 	producer.onClose = func(ch <-chan uint8) {
 		for _, coordinator := range ps.producersCoordinator {
 			coordinator.maybeCleanClients()
+			go coordinator.rebalance()
 		}
 	}
 
 	return producer, err
 }
 
+// getCoordinator returns the coordinator of the leader,
+// it must be called with ps.mutex held
+func (ps *producersEnvironment) getCoordinator(leader *Broker) *environmentCoordinator {
+	if ps.producersCoordinator[leader.hostPort()] == nil {
+		coordinator := &environmentCoordinator{
+			clientsPerContext: map[int]*Client{},
+			mutex:             &sync.Mutex{},
+			maxItemsForClient: ps.maxItemsForClient,
+			mutexContext:      &sync.RWMutex{},
+			nextId:            0,
+			options:           ps.options,
+			events:            ps.events,
+		}
+		if ps.locator != nil {
+			coordinator.onMetadataUpdate = ps.migrateProducers
+		}
+		ps.producersCoordinator[leader.hostPort()] = coordinator
+	}
+	return ps.producersCoordinator[leader.hostPort()]
+}
+
+// migrateProducers moves the producers of the stream to the new leader
+// after a metadata update. The sends are paused, the producers are
+// declared again with the same ID and name and the unconfirmed
+// messages are sent again. When the leader is not found within the
+// BackoffPolicy the producers are closed, like before the migration.
+func (ps *producersEnvironment) migrateProducers(client *Client, streamName string) {
+	var producers []*Producer
+	for _, producer := range client.coordinator.producersList() {
+		if producer.GetStreamName() == streamName && producer.getStatus() == open {
+			producer.pause()
+			_ = client.coordinator.removeById(producer.ID, client.coordinator.producers)
+			producers = append(producers, producer)
+		}
+	}
+
+	for _, producer := range producers {
+		err := ps.migrateProducer(producer)
+		if err != nil {
+			logs.LogWarn("producer id: %d, stream: %s can't move to the new leader: %s",
+				producer.ID, streamName, err)
+			producer.closeAfterMetadataUpdate(err)
+		} else {
+			producer.options.client.emit(LifecycleEvent{Type: EventProducerMigrated,
+				StreamName: streamName, Name: producer.GetName()})
+		}
+		producer.resume()
+	}
+
+	if client.coordinator.ProducersCount() == 0 {
+		_ = client.Close()
+	}
+	for _, coordinator := range ps.getCoordinators() {
+		coordinator.maybeCleanClients()
+	}
+}
+
+func (ps *producersEnvironment) migrateProducer(producer *Producer) error {
+	// the sequence queried from the new leader is behind the
+	// publishing IDs of the messages not yet stored
+	sequence := atomic.LoadInt64(&producer.sequence)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := ps.reuseProducer(producer)
+		if err == nil {
+			producer.keepSequence(sequence)
+			return producer.resendUnConfirmed()
+		}
+		if errors.Is(err, StreamDoesNotExist) {
+			// the stream was deleted, there is no new leader
+			return err
+		}
+		delay, retry := ps.options.BackoffPolicy.NextDelay(attempt, time.Since(start))
+		if !retry {
+			return err
+		}
+		ps.events.publish(LifecycleEvent{Type: EventReconnectAttempt, StreamName: producer.GetStreamName(),
+			Name: producer.GetName(), Attempt: attempt, Reason: "producer migration", Err: err})
+		time.Sleep(delay)
+	}
+}
+
+func (ps *producersEnvironment) reuseProducer(producer *Producer) error {
+	clientLocator, err := ps.locator()
+	if err != nil {
+		return err
+	}
+	ps.mutex.Lock()
+	leader, err := clientLocator.BrokerLeader(producer.GetStreamName())
+	if err != nil {
+		ps.mutex.Unlock()
+		return err
+	}
+	coordinator := ps.getCoordinator(leader)
+	ps.mutex.Unlock()
+	leader.cloneFrom(clientLocator.broker)
+	leader.resolveWith(ps.options.AddressResolver)
+	return coordinator.reuseProducer(leader, producer)
+}
+
 func (ps *producersEnvironment) close() error {
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
@@ -562,13 +1022,17 @@ type consumersEnvironment struct {
 	consumersCoordinator map[string]*environmentCoordinator
 	maxItemsForClient    int
 	PublishErrorListener ChannelPublishError
+	options              *EnvironmentOptions
+	events               *eventBus
 }
 
-func newConsumerEnvironment(maxItemsForClient int) *consumersEnvironment {
+func newConsumerEnvironment(options *EnvironmentOptions, events *eventBus) *consumersEnvironment {
 	producers := &consumersEnvironment{
 		mutex:                &sync.Mutex{},
 		consumersCoordinator: map[string]*environmentCoordinator{},
-		maxItemsForClient:    maxItemsForClient,
+		maxItemsForClient:    options.MaxConsumersPerClient,
+		options:              options,
+		events:               events,
 	}
 	return producers
 }
@@ -577,9 +1041,13 @@ func (ps *consumersEnvironment) NewSubscriber(clientLocator *Client, streamName
 	messagesHandler MessagesHandler,
 	consumerOptions *ConsumerOptions) (*Consumer, error) {
 	ps.mutex.Lock()
-	defer ps.mutex.Unlock()
-	consumerBroker, err := clientLocator.BrokerForConsumer(streamName)
+	policy := ps.options.ConsumerPlacementPolicy
+	if consumerOptions != nil && consumerOptions.PlacementPolicy != nil {
+		policy = consumerOptions.PlacementPolicy
+	}
+	consumerBroker, err := clientLocator.brokerForConsumer(streamName, policy, ps.connections)
 	if err != nil {
+		ps.mutex.Unlock()
 		return nil, err
 	}
 	if ps.consumersCoordinator[consumerBroker.hostPort()] == nil {
@@ -589,10 +1057,16 @@ func (ps *consumersEnvironment) NewSubscriber(clientLocator *Client, streamName
 			maxItemsForClient: ps.maxItemsForClient,
 			mutexContext:      &sync.RWMutex{},
 			nextId:            0,
+			options:           ps.options,
+			events:            ps.events,
 		}
 	}
+	coordinator := ps.consumersCoordinator[consumerBroker.hostPort()]
+	// ps.mutex is not held during the connection backoff
+	ps.mutex.Unlock()
 	consumerBroker.cloneFrom(clientLocator.broker)
-	consumer, err := ps.consumersCoordinator[consumerBroker.hostPort()].
+	consumerBroker.resolveWith(ps.options.AddressResolver)
+	consumer, err := coordinator.
 		newConsumer(consumerBroker, streamName, messagesHandler, consumerOptions)
 	if err != nil {
 		return nil, err
@@ -605,6 +1079,16 @@ func (ps *consumersEnvironment) NewSubscriber(clientLocator *Client, streamName
 	return consumer, err
 }
 
+// connections counts the consumer connections to the node,
+// the caller holds ps.mutex
+func (ps *consumersEnvironment) connections(broker *Broker) int {
+	coordinator := ps.consumersCoordinator[broker.hostPort()]
+	if coordinator == nil {
+		return 0
+	}
+	return len(coordinator.getClientsPerContext())
+}
+
 func (ps *consumersEnvironment) close() error {
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
@@ -0,0 +1,131 @@
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+)
+
+type LifecycleEventType string
+
+const (
+	EventConnectionOpened LifecycleEventType = "connection-opened"
+	EventConnectionClosed LifecycleEventType = "connection-closed"
+	EventHeartbeatMissed  LifecycleEventType = "heartbeat-missed"
+	EventMetadataUpdate   LifecycleEventType = "metadata-update"
+	EventProducerAdded    LifecycleEventType = "producer-added"
+	EventProducerRemoved  LifecycleEventType = "producer-removed"
+	// EventProducerMaxInFlight is emitted when a producer reaches
+	// ProducerOptions.MaxInFlight and Send waits for confirmations
+	EventProducerMaxInFlight LifecycleEventType = "producer-max-in-flight"
+	// EventProducerMigrated is emitted when a producer moved
+	// to the new leader of the stream, see the metadata update
+	EventProducerMigrated LifecycleEventType = "producer-migrated"
+	EventConsumerAdded    LifecycleEventType = "consumer-added"
+	EventConsumerRemoved  LifecycleEventType = "consumer-removed"
+	EventReconnectAttempt LifecycleEventType = "reconnect-attempt"
+)
+
+// LifecycleEvent is a state change of a connection, producer or consumer.
+// The fields not related to the Type are empty.
+type LifecycleEvent struct {
+	Type       LifecycleEventType
+	Time       time.Time
+	Connection string
+	Broker     string
+	StreamName string
+	// Name is the producer or consumer name
+	Name string
+	// Attempt counts the heartbeats missed or the reconnect attempts
+	Attempt int
+	Reason  string
+	Err     error
+}
+
+// eventBus dispatches the events to the subscribers without blocking
+// the client: when a subscriber channel is full the event is dropped
+type eventBus struct {
+	mutex       *sync.Mutex
+	subscribers map[int]chan LifecycleEvent
+	nextId      int
+	closed      bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		mutex:       &sync.Mutex{},
+		subscribers: map[int]chan LifecycleEvent{},
+	}
+}
+
+func (b *eventBus) subscribe() (<-chan LifecycleEvent, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ch := make(chan LifecycleEvent, defaultEventsBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.nextId++
+	id := b.nextId
+	b.subscribers[id] = ch
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if subscriber, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(subscriber)
+		}
+	}
+}
+
+func (b *eventBus) publish(event LifecycleEvent) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			logs.LogDebug("event %s dropped, the listener is too slow", event.Type)
+		}
+	}
+}
+
+func (b *eventBus) close() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for id, subscriber := range b.subscribers {
+		delete(b.subscribers, id)
+		close(subscriber)
+	}
+}
+
+// setEvents enables the lifecycle events of the client
+// and of its producers and consumers
+func (c *Client) setEvents(events *eventBus) {
+	c.events = events
+	c.coordinator.notify = c.emit
+}
+
+// emit fills the connection details and publishes the event
+func (c *Client) emit(event LifecycleEvent) {
+	if c == nil || c.events == nil {
+		return
+	}
+	event.Connection = c.clientProperties.items["connection_name"]
+	if c.broker != nil {
+		event.Broker = c.broker.hostPort()
+	}
+	c.events.publish(event)
+}
@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
+
+var _ = Describe("Lifecycle events bus", func() {
+
+	It("Dispatch to all the subscribers", func() {
+		bus := newEventBus()
+		first, unsubscribeFirst := bus.subscribe()
+		second, _ := bus.subscribe()
+
+		bus.publish(LifecycleEvent{Type: EventProducerAdded, StreamName: "orders"})
+		event := <-first
+		Expect(event.Type).To(Equal(EventProducerAdded))
+		Expect(event.Time.IsZero()).To(BeFalse())
+		Expect((<-second).StreamName).To(Equal("orders"))
+
+		unsubscribeFirst()
+		_, open := <-first
+		Expect(open).To(BeFalse())
+		unsubscribeFirst()
+
+		bus.close()
+		_, open = <-second
+		Expect(open).To(BeFalse())
+		closed, _ := bus.subscribe()
+		_, open = <-closed
+		Expect(open).To(BeFalse())
+		bus.publish(LifecycleEvent{Type: EventProducerAdded})
+	})
+
+	It("Drop the events of a slow subscriber", func() {
+		bus := newEventBus()
+		events, _ := bus.subscribe()
+		for i := 0; i < defaultEventsBufferSize+10; i++ {
+			bus.publish(LifecycleEvent{Type: EventHeartbeatMissed, Attempt: i})
+		}
+		Expect(len(events)).To(Equal(defaultEventsBufferSize))
+		Expect((<-events).Attempt).To(Equal(0))
+	})
+
+	It("A producer at MaxInFlight", func() {
+		bus := newEventBus()
+		events, _ := bus.subscribe()
+		client := newClient("test-client", nil)
+		client.setEvents(bus)
+		producer, err := client.coordinator.NewProducer(NewProducerOptions().SetMaxInFlight(1))
+		Expect(err).NotTo(HaveOccurred())
+		producer.options.client = client
+		producer.options.streamName = "orders"
+		Expect(producer.acquireInFlight(context.Background())).NotTo(HaveOccurred())
+		Expect(events).NotTo(Receive())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		Expect(producer.acquireInFlight(ctx)).To(Equal(context.DeadlineExceeded))
+		event := <-events
+		Expect(event.Type).To(Equal(EventProducerMaxInFlight))
+		Expect(event.StreamName).To(Equal("orders"))
+	})
+
+})
+
+var _ = Describe("Environment events", func() {
+
+	It("Connections, producers and consumers", func() {
+		env, err := NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		events, unsubscribe := env.Events()
+		defer unsubscribe()
+		streamName := uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+
+		producer, err := env.NewProducer(streamName, NewProducerOptions().SetProducerName("events"))
+		Expect(err).NotTo(HaveOccurred())
+		consumer, err := env.NewConsumer(streamName, func(consumerContext ConsumerContext, message *amqp.Message) {},
+			NewConsumerOptions().SetConsumerName("events"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.Close()).NotTo(HaveOccurred())
+		Expect(consumer.Close()).NotTo(HaveOccurred())
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+
+		var types []LifecycleEventType
+		for event := range events {
+			if event.StreamName != "" {
+				Expect(event.StreamName).To(Equal(streamName))
+			}
+			types = append(types, event.Type)
+		}
+		Expect(types).To(ContainElements(EventConnectionOpened, EventProducerAdded, EventProducerRemoved,
+			EventConsumerAdded, EventConsumerRemoved, EventConnectionClosed))
+	})
+
+})
@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"reflect"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
+
+// MessageFilter decides if a message is passed to the MessagesHandler.
+// It is evaluated right after the message is decoded,
+// the messages filtered out still move the consumer offset.
+type MessageFilter func(message *amqp.Message) bool
+
+// StreamFilter configures the broker side filtering.
+// The broker sends only the chunks that contain at least one message
+// with a filter value in Values, see ProducerOptions.FilterValue.
+// A chunk can still contain other messages, so PostFilter is
+// evaluated on each message to drop them.
+type StreamFilter struct {
+	Values []string
+	// MatchUnfiltered asks the broker to send the messages
+	// published without a filter value too
+	MatchUnfiltered bool
+	PostFilter      MessageFilter
+}
+
+func NewStreamFilter(values []string, postFilter MessageFilter) *StreamFilter {
+	return &StreamFilter{
+		Values:     values,
+		PostFilter: postFilter,
+	}
+}
+
+func (s *StreamFilter) SetMatchUnfiltered(matchUnfiltered bool) *StreamFilter {
+	s.MatchUnfiltered = matchUnfiltered
+	return s
+}
+
+// PropertyEquals accepts the messages with the application property
+// key equal to value
+func PropertyEquals(key string, value interface{}) MessageFilter {
+	return PropertyIn(key, value)
+}
+
+// PropertyIn accepts the messages with the application property
+// key equal to one of values. The numbers are compared by value,
+// so int(1) is equal to int64(1), uint8(1) and float64(1)
+func PropertyIn(key string, values ...interface{}) MessageFilter {
+	return func(message *amqp.Message) bool {
+		if message.ApplicationProperties == nil {
+			return false
+		}
+		property, ok := message.ApplicationProperties[key]
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if propertyEqual(property, value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func propertyEqual(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !isNumber(va) || !isNumber(vb) {
+		return reflect.DeepEqual(a, b)
+	}
+	switch {
+	case isFloat(va) || isFloat(vb):
+		return toFloat(va) == toFloat(vb)
+	case isUnsigned(va) && isUnsigned(vb):
+		return va.Uint() == vb.Uint()
+	case isUnsigned(va):
+		return vb.Int() >= 0 && uint64(vb.Int()) == va.Uint()
+	case isUnsigned(vb):
+		return va.Int() >= 0 && uint64(va.Int()) == vb.Uint()
+	default:
+		return va.Int() == vb.Int()
+	}
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return isUnsigned(v) || isFloat(v)
+}
+
+func isUnsigned(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isFloat(v reflect.Value) bool {
+	return v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isFloat(v):
+		return v.Float()
+	case isUnsigned(v):
+		return float64(v.Uint())
+	default:
+		return float64(v.Int())
+	}
+}
+
+// AllOf accepts the messages accepted by all the filters
+func AllOf(filters ...MessageFilter) MessageFilter {
+	return func(message *amqp.Message) bool {
+		for _, filter := range filters {
+			if !filter(message) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf accepts the messages accepted by at least one of the filters
+func AnyOf(filters ...MessageFilter) MessageFilter {
+	return func(message *amqp.Message) bool {
+		for _, filter := range filters {
+			if filter(message) {
+				return true
+			}
+		}
+		return false
+	}
+}
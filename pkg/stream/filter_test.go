@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
+
+var _ = Describe("Message filters", func() {
+
+	withProperties := func(properties map[string]interface{}) *amqp.Message {
+		return &amqp.Message{ApplicationProperties: properties}
+	}
+
+	It("PropertyEquals", func() {
+		filter := PropertyEquals("tenant", "blue")
+		Expect(filter(withProperties(map[string]interface{}{"tenant": "blue"}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"tenant": "red"}))).To(BeFalse())
+		Expect(filter(withProperties(map[string]interface{}{"region": "blue"}))).To(BeFalse())
+		Expect(filter(withProperties(nil))).To(BeFalse())
+	})
+
+	It("PropertyIn", func() {
+		filter := PropertyIn("tenant", "blue", "red")
+		Expect(filter(withProperties(map[string]interface{}{"tenant": "blue"}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"tenant": "red"}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"tenant": "green"}))).To(BeFalse())
+	})
+
+	It("Numeric properties", func() {
+		filter := PropertyEquals("priority", 1)
+		Expect(filter(withProperties(map[string]interface{}{"priority": int64(1)}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"priority": int32(1)}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"priority": uint8(1)}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"priority": float64(1)}))).To(BeTrue())
+		Expect(filter(withProperties(map[string]interface{}{"priority": int64(2)}))).To(BeFalse())
+		Expect(filter(withProperties(map[string]interface{}{"priority": float32(1.5)}))).To(BeFalse())
+		Expect(filter(withProperties(map[string]interface{}{"priority": "1"}))).To(BeFalse())
+
+		Expect(PropertyEquals("priority", int64(-1))(withProperties(
+			map[string]interface{}{"priority": ^uint64(0)}))).To(BeFalse())
+		Expect(PropertyIn("priority", uint16(3), 2.5)(withProperties(
+			map[string]interface{}{"priority": float32(2.5)}))).To(BeTrue())
+		Expect(PropertyIn("priority", uint16(3), 2.5)(withProperties(
+			map[string]interface{}{"priority": int8(3)}))).To(BeTrue())
+	})
+
+	It("AllOf/AnyOf", func() {
+		message := withProperties(map[string]interface{}{"tenant": "blue", "region": "eu"})
+		Expect(AllOf(PropertyEquals("tenant", "blue"), PropertyEquals("region", "eu"))(message)).To(BeTrue())
+		Expect(AllOf(PropertyEquals("tenant", "blue"), PropertyEquals("region", "us"))(message)).To(BeFalse())
+		Expect(AnyOf(PropertyEquals("tenant", "red"), PropertyEquals("region", "eu"))(message)).To(BeTrue())
+		Expect(AnyOf(PropertyEquals("tenant", "red"), PropertyEquals("region", "us"))(message)).To(BeFalse())
+	})
+
+	It("StreamFilter subscription properties", func() {
+		options := NewConsumerOptions()
+		Expect(options.subscriptionProperties()).To(BeEmpty())
+		options.SetStreamFilter(NewStreamFilter([]string{"blue", "red"}, nil).
+			SetMatchUnfiltered(true))
+		Expect(options.subscriptionProperties()).To(Equal(map[string]string{
+			"filter.0":         "blue",
+			"filter.1":         "red",
+			"match-unfiltered": "true",
+		}))
+	})
+
+	It("StreamFilter PostFilter and Filter", func() {
+		options := NewConsumerOptions().
+			SetStreamFilter(NewStreamFilter([]string{"blue"}, PropertyEquals("tenant", "blue"))).
+			SetFilter(PropertyEquals("region", "eu"))
+		Expect(options.accept(withProperties(map[string]interface{}{"tenant": "blue", "region": "eu"}))).To(BeTrue())
+		Expect(options.accept(withProperties(map[string]interface{}{"tenant": "red", "region": "eu"}))).To(BeFalse())
+		Expect(options.accept(withProperties(map[string]interface{}{"tenant": "blue", "region": "us"}))).To(BeFalse())
+	})
+
+	It("Filter value entry size", func() {
+		value := "blue"
+		Expect(messageSequence{size: 10}.entrySize()).To(Equal(publishEntryHeaderSize + 10))
+		Expect(messageSequence{size: 10, filterValue: &value}.entrySize()).
+			To(Equal(publishEntryHeaderSize + 2 + 4 + 10))
+		empty := ""
+		var b = bytes.NewBuffer(make([]byte, 0))
+		writeNullableString(b, empty)
+		Expect(b.Len()).To(Equal(messageSequence{filterValue: &empty}.entrySize() - publishEntryHeaderSize))
+	})
+
+})
@@ -0,0 +1,390 @@
+package stream
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
+)
+
+const (
+	// SelectNewConnection is returned by MultiplexingStrategy.Select
+	// to open a new shared connection
+	SelectNewConnection = -1
+	// SelectDedicatedConnection is returned by MultiplexingStrategy.Select
+	// to open a connection used only by the entity
+	SelectDedicatedConnection = -2
+)
+
+// MultiplexedEntity is the producer or consumer that needs a connection
+type MultiplexedEntity struct {
+	// Kind is "producer" or "consumer"
+	Kind       string
+	StreamName string
+	Name       string
+}
+
+// ClientLoad describes a shared connection of the environment
+type ClientLoad struct {
+	Id int
+	// Entities is the number of producers or consumers of the connection
+	Entities int
+	// MaxEntities is MaxProducersPerClient or MaxConsumersPerClient
+	MaxEntities int
+	// PendingBytes is the size of the messages waiting for a confirmation,
+	// zero for the consumer connections
+	PendingBytes int
+}
+
+// Full is true when the connection can't take more entities
+func (c ClientLoad) Full() bool {
+	return c.Entities >= c.MaxEntities
+}
+
+// MultiplexingStrategy chooses the connection of the new producers and
+// consumers. Select receives the shared connections ordered by Id, the
+// dedicated ones are never shared, and returns the position of the chosen
+// one, SelectNewConnection or SelectDedicatedConnection. A full connection
+// is never used, a new one is opened instead.
+// The strategy is shared by all the nodes and must be safe for concurrent use.
+type MultiplexingStrategy interface {
+	Select(entity MultiplexedEntity, clients []ClientLoad) int
+}
+
+type fillFirstStrategy struct{}
+
+// NewFillFirstStrategy uses the first connection that is not full,
+// it is the default
+func NewFillFirstStrategy() MultiplexingStrategy {
+	return fillFirstStrategy{}
+}
+
+func (fillFirstStrategy) Select(entity MultiplexedEntity, clients []ClientLoad) int {
+	for i, client := range clients {
+		if !client.Full() {
+			return i
+		}
+	}
+	return SelectNewConnection
+}
+
+type roundRobinStrategy struct {
+	mutex       *sync.Mutex
+	connections int
+	next        int
+}
+
+// NewRoundRobinStrategy opens up to connections connections and
+// spreads the entities over them in turn
+func NewRoundRobinStrategy(connections int) MultiplexingStrategy {
+	if connections < 1 {
+		connections = 1
+	}
+	return &roundRobinStrategy{mutex: &sync.Mutex{}, connections: connections}
+}
+
+func (r *roundRobinStrategy) Select(entity MultiplexedEntity, clients []ClientLoad) int {
+	if len(clients) < r.connections {
+		return SelectNewConnection
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := 0; i < len(clients); i++ {
+		position := (r.next + i) % len(clients)
+		if !clients[position].Full() {
+			r.next = position + 1
+			return position
+		}
+	}
+	return SelectNewConnection
+}
+
+type leastBusyStrategy struct{}
+
+// NewLeastBusyStrategy uses the connection with fewer pending bytes,
+// the one with fewer entities when the pending bytes are the same
+func NewLeastBusyStrategy() MultiplexingStrategy {
+	return leastBusyStrategy{}
+}
+
+func (leastBusyStrategy) Select(entity MultiplexedEntity, clients []ClientLoad) int {
+	selected := SelectNewConnection
+	for i, client := range clients {
+		if client.Full() {
+			continue
+		}
+		if selected == SelectNewConnection ||
+			client.PendingBytes < clients[selected].PendingBytes ||
+			(client.PendingBytes == clients[selected].PendingBytes &&
+				client.Entities < clients[selected].Entities) {
+			selected = i
+		}
+	}
+	return selected
+}
+
+type rebalancingStrategy struct {
+	MultiplexingStrategy
+}
+
+// NewRebalancingStrategy is strategy, NewFillFirstStrategy when nil, that
+// also closes the shared producer connections no longer needed when some
+// producers are closed: the producers of the connection with fewer
+// producers move to the connections strategy chooses for them, only when
+// they all fit in the existing ones. The moving producers hold their sends
+// until the messages already sent are confirmed.
+func NewRebalancingStrategy(strategy MultiplexingStrategy) MultiplexingStrategy {
+	if strategy == nil {
+		strategy = NewFillFirstStrategy()
+	}
+	return rebalancingStrategy{MultiplexingStrategy: strategy}
+}
+
+func isRebalancing(strategy MultiplexingStrategy) bool {
+	_, ok := strategy.(rebalancingStrategy)
+	return ok
+}
+
+type dedicatedStrategy struct {
+	fallback  MultiplexingStrategy
+	producers map[string]bool
+}
+
+// NewDedicatedStrategy gives a connection of its own to the producers with
+// one of the names, so a hot producer doesn't slow down the others.
+// The other entities use fallback, NewFillFirstStrategy when nil.
+func NewDedicatedStrategy(fallback MultiplexingStrategy, producerNames ...string) MultiplexingStrategy {
+	if fallback == nil {
+		fallback = NewFillFirstStrategy()
+	}
+	producers := map[string]bool{}
+	for _, name := range producerNames {
+		producers[name] = true
+	}
+	return &dedicatedStrategy{fallback: fallback, producers: producers}
+}
+
+func (d *dedicatedStrategy) Select(entity MultiplexedEntity, clients []ClientLoad) int {
+	if entity.Kind == connectionKindProducer && entity.Name != "" && d.producers[entity.Name] {
+		return SelectDedicatedConnection
+	}
+	return d.fallback.Select(entity, clients)
+}
+
+// clientLoads describes the shared clients of the coordinator,
+// it must be called with cc.mutex held
+func (cc *environmentCoordinator) clientLoads(kind string) ([]ClientLoad, []*Client) {
+	ids := make([]int, 0, len(cc.clientsPerContext))
+	cc.mutexContext.RLock()
+	for id, client := range cc.clientsPerContext {
+		if !client.dedicated && !client.emptying {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	loads := make([]ClientLoad, len(ids))
+	clients := make([]*Client, len(ids))
+	for i, id := range ids {
+		clients[i] = cc.clientsPerContext[id]
+		loads[i] = ClientLoad{Id: id, MaxEntities: cc.maxItemsForClient}
+		if kind == connectionKindProducer {
+			loads[i].Entities = clients[i].coordinator.ProducersCount()
+			for _, producer := range clients[i].coordinator.producersList() {
+				loads[i].PendingBytes += producer.pendingBytes()
+			}
+		} else {
+			loads[i].Entities = clients[i].coordinator.ConsumersCount()
+		}
+	}
+	cc.mutexContext.RUnlock()
+	return loads, clients
+}
+
+// selectClient applies the strategy, a nil client means a new connection,
+// it must be called with cc.mutex held
+func (cc *environmentCoordinator) selectClient(strategy MultiplexingStrategy,
+	entity MultiplexedEntity) (client *Client, dedicated bool) {
+	if strategy == nil {
+		strategy = NewFillFirstStrategy()
+	}
+	loads, clients := cc.clientLoads(entity.Kind)
+	selected := strategy.Select(entity, loads)
+	switch {
+	case selected == SelectDedicatedConnection:
+		return nil, true
+	case selected < 0 || selected >= len(clients) || loads[selected].Full():
+		return nil, false
+	}
+	return clients[selected], false
+}
+
+// rebalance closes the shared producer connections that are no longer
+// needed, only when the strategy opts in, see NewRebalancingStrategy
+func (cc *environmentCoordinator) rebalance() {
+	if !isRebalancing(cc.options.ProducerMultiplexing) {
+		return
+	}
+	for cc.rebalanceConnection() {
+	}
+}
+
+// rebalanceConnection empties and closes a connection, it returns
+// false when nothing moved. The confirmations are awaited without
+// cc.mutex, the connection is not chosen for new producers meanwhile.
+func (cc *environmentCoordinator) rebalanceConnection() bool {
+	cc.mutex.Lock()
+	source, producers, _ := cc.rebalancePlan(nil)
+	if source == nil {
+		cc.mutex.Unlock()
+		return false
+	}
+	source.emptying = true
+	cc.mutex.Unlock()
+
+	moved := false
+	defer func() {
+		if !moved {
+			cc.mutex.Lock()
+			source.emptying = false
+			cc.mutex.Unlock()
+		}
+	}()
+	for _, producer := range producers {
+		producer.pause()
+		defer producer.resume()
+	}
+	for _, producer := range producers {
+		if !producer.waitSentConfirmed(rebalanceConfirmTimeout) {
+			logs.LogWarn("producer id: %d, stream: %s can't move to another connection: "+
+				"messages not confirmed in %s", producer.ID, producer.GetStreamName(), rebalanceConfirmTimeout)
+			return false
+		}
+	}
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	// the connections can be changed in the meantime
+	_, current, moves := cc.rebalancePlan(source)
+	if !sameProducers(producers, current) {
+		return false
+	}
+	for i, producer := range current {
+		if err := producer.moveTo(moves[i]); err != nil {
+			logs.LogWarn("producer id: %d, stream: %s can't move to another connection: %s",
+				producer.ID, producer.GetStreamName(), err)
+			return false
+		}
+	}
+	moved = true
+
+	_ = source.Close()
+	cc.mutexContext.Lock()
+	for id, client := range cc.clientsPerContext {
+		if client == source {
+			delete(cc.clientsPerContext, id)
+		}
+	}
+	cc.mutexContext.Unlock()
+	return true
+}
+
+// rebalancePlan chooses the connection to empty, the one with fewer
+// producers when source is nil, and the targets of its producers.
+// It returns a nil source when the producers don't fit in the other
+// connections, it must be called with cc.mutex held
+func (cc *environmentCoordinator) rebalancePlan(source *Client) (*Client, []*Producer, []*Client) {
+	loads, clients := cc.clientLoads(connectionKindProducer)
+	if source == nil {
+		selected := -1
+		for i := range clients {
+			if !clients[i].socket.isOpen() || loads[i].Entities == 0 {
+				continue
+			}
+			if selected < 0 || loads[i].Entities <= loads[selected].Entities {
+				selected = i
+			}
+		}
+		if selected < 0 {
+			return nil, nil, nil
+		}
+		source = clients[selected]
+	} else if !source.socket.isOpen() {
+		return nil, nil, nil
+	}
+
+	var targetLoads []ClientLoad
+	var targets []*Client
+	for i := range clients {
+		if clients[i] != source && clients[i].socket.isOpen() {
+			targetLoads = append(targetLoads, loads[i])
+			targets = append(targets, clients[i])
+		}
+	}
+	producers := source.coordinator.producersList()
+	if len(targets) == 0 || len(producers) == 0 {
+		return nil, nil, nil
+	}
+
+	moves := make([]*Client, len(producers))
+	takenIds := map[*Client]map[uint8]bool{}
+	for i, producer := range producers {
+		if producer.getStatus() != open {
+			return nil, nil, nil
+		}
+		selected := cc.options.ProducerMultiplexing.Select(MultiplexedEntity{Kind: connectionKindProducer,
+			StreamName: producer.GetStreamName(), Name: producer.GetName()}, targetLoads)
+		if selected < 0 || selected >= len(targets) || targetLoads[selected].Full() {
+			return nil, nil, nil
+		}
+		target := targets[selected]
+		if _, err := target.coordinator.GetProducerById(producer.ID); err == nil || takenIds[target][producer.ID] {
+			return nil, nil, nil
+		}
+		if takenIds[target] == nil {
+			takenIds[target] = map[uint8]bool{}
+		}
+		takenIds[target][producer.ID] = true
+		targetLoads[selected].Entities++
+		moves[i] = target
+	}
+	return source, producers, moves
+}
+
+// sameProducers is true when the lists have the same producers
+func sameProducers(producers []*Producer, others []*Producer) bool {
+	if len(producers) != len(others) {
+		return false
+	}
+	set := map[*Producer]bool{}
+	for _, producer := range producers {
+		set[producer] = true
+	}
+	for _, producer := range others {
+		if !set[producer] {
+			return false
+		}
+	}
+	return true
+}
+
+// moveTo declares the producer on the target client with the same ID
+// and name, then deletes it from its current client. The producer must
+// be paused and its messages sent confirmed, see rebalanceConnection.
+func (producer *Producer) moveTo(target *Client) error {
+	source := producer.options.client
+	sequence := atomic.LoadInt64(&producer.sequence)
+	_, err := target.ReusePublisher(producer.GetStreamName(), producer)
+	if err != nil {
+		_ = target.coordinator.removeById(producer.ID, target.coordinator.producers)
+		producer.options.client = source
+		return err
+	}
+	producer.keepSequence(sequence)
+	_ = source.coordinator.removeById(producer.ID, source.coordinator.producers)
+	if err := source.unregisterPublisher(producer.ID); err != nil {
+		logs.LogWarn("producer id: %d, can't delete the publisher of the old connection: %s",
+			producer.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
+
+var _ = Describe("Multiplexing strategies", func() {
+	producer := MultiplexedEntity{Kind: connectionKindProducer, StreamName: "orders", Name: "hot"}
+	loads := func(entities ...int) []ClientLoad {
+		var res []ClientLoad
+		for i, e := range entities {
+			res = append(res, ClientLoad{Id: i + 1, Entities: e, MaxEntities: 3})
+		}
+		return res
+	}
+
+	It("Fill first", func() {
+		strategy := NewFillFirstStrategy()
+		Expect(strategy.Select(producer, nil)).To(Equal(SelectNewConnection))
+		Expect(strategy.Select(producer, loads(3, 1, 0))).To(Equal(1))
+		Expect(strategy.Select(producer, loads(3, 3))).To(Equal(SelectNewConnection))
+	})
+
+	It("Round robin", func() {
+		strategy := NewRoundRobinStrategy(2)
+		Expect(strategy.Select(producer, loads(1))).To(Equal(SelectNewConnection))
+		clients := loads(1, 1)
+		Expect(strategy.Select(producer, clients)).To(Equal(0))
+		Expect(strategy.Select(producer, clients)).To(Equal(1))
+		Expect(strategy.Select(producer, clients)).To(Equal(0))
+		Expect(strategy.Select(producer, loads(3, 1))).To(Equal(1))
+		Expect(strategy.Select(producer, loads(3, 3))).To(Equal(SelectNewConnection))
+	})
+
+	It("Least busy", func() {
+		strategy := NewLeastBusyStrategy()
+		clients := loads(1, 2, 1, 3)
+		clients[0].PendingBytes = 1000
+		clients[1].PendingBytes = 10
+		clients[2].PendingBytes = 10
+		Expect(strategy.Select(producer, clients)).To(Equal(2))
+		Expect(strategy.Select(producer, loads(3))).To(Equal(SelectNewConnection))
+	})
+
+	It("Dedicated connection", func() {
+		strategy := NewDedicatedStrategy(nil, "hot")
+		Expect(strategy.Select(producer, loads(0))).To(Equal(SelectDedicatedConnection))
+		Expect(strategy.Select(MultiplexedEntity{Kind: connectionKindProducer, Name: "cold"},
+			loads(0))).To(Equal(0))
+		Expect(strategy.Select(MultiplexedEntity{Kind: connectionKindConsumer, Name: "hot"},
+			loads(0))).To(Equal(0))
+	})
+
+	It("Rebalance only when the strategy opts in", func() {
+		Expect(isRebalancing(NewFillFirstStrategy())).To(BeFalse())
+		strategy := NewRebalancingStrategy(NewDedicatedStrategy(nil, "hot"))
+		Expect(isRebalancing(strategy)).To(BeTrue())
+		Expect(strategy.Select(producer, loads(0))).To(Equal(SelectDedicatedConnection))
+		Expect(NewRebalancingStrategy(nil).Select(producer, loads(3, 1))).To(Equal(1))
+	})
+
+	It("A write in progress holds the move", func() {
+		client := newClient("test-client", nil)
+		producer, err := client.coordinator.NewProducer(NewProducerOptions())
+		Expect(err).NotTo(HaveOccurred())
+		// the publish task passed the pause
+		Expect(producer.beginWrite(context.Background())).NotTo(HaveOccurred())
+		producer.pause()
+		Expect(producer.waitSentConfirmed(50 * time.Millisecond)).To(BeFalse())
+		producer.endWrite()
+		Expect(producer.waitSentConfirmed(50 * time.Millisecond)).To(BeTrue())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(producer.beginWrite(ctx)).To(Equal(context.DeadlineExceeded))
+		producer.resume()
+		Expect(producer.beginWrite(context.Background())).NotTo(HaveOccurred())
+		producer.endWrite()
+	})
+
+	It("Dedicated producer connection and rebalance", func() {
+		env, err := NewEnvironment(NewEnvironmentOptions().SetMaxProducersPerClient(2).
+			SetProducerMultiplexing(NewRebalancingStrategy(NewDedicatedStrategy(NewFillFirstStrategy(), "hot"))))
+		Expect(err).NotTo(HaveOccurred())
+		streamName := uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+
+		hot, err := env.NewProducer(streamName, NewProducerOptions().SetProducerName("hot"))
+		Expect(err).NotTo(HaveOccurred())
+		var producers []*Producer
+		for i := 0; i < 4; i++ {
+			producer, err := env.NewProducer(streamName, nil)
+			Expect(err).NotTo(HaveOccurred())
+			producers = append(producers, producer)
+		}
+		Expect(hot.options.client.dedicated).To(BeTrue())
+		Expect(hot.options.client.coordinator.ProducersCount()).To(Equal(1))
+		Expect(len(env.producers.getCoordinators()["localhost:5552"].
+			getClientsPerContext())).To(Equal(3))
+
+		// one slot is free on each shared connection,
+		// the producers of one of them move to the other
+		Expect(producers[0].Close()).NotTo(HaveOccurred())
+		Expect(producers[3].Close()).NotTo(HaveOccurred())
+		Eventually(func() int {
+			return len(env.producers.getCoordinators()["localhost:5552"].getClientsPerContext())
+		}, 5*time.Second).Should(Equal(2))
+		Expect(producers[1].options.client).To(Equal(producers[2].options.client))
+		Expect(producers[1].Send(amqp.NewMessage([]byte("rebalance")))).NotTo(HaveOccurred())
+		Expect(producers[2].Send(amqp.NewMessage([]byte("rebalance")))).NotTo(HaveOccurred())
+
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"fmt"
+)
+
+// ConsumerPlacementPolicy chooses the node of the consumer connection among
+// the leader and the replicas of the stream. connections returns how many
+// consumer connections the environment has to a node.
+// PlacementRandom, PlacementLeaderOnly, PlacementReplicasOnly and
+// PlacementLeastLoaded are provided, any function with the same signature
+// can be used, for example to choose the nodes of an availability zone.
+type ConsumerPlacementPolicy func(metadata *StreamMetadata, connections func(broker *Broker) int) (*Broker, error)
+
+// PlacementRandom chooses a random node, it is the default
+func PlacementRandom(metadata *StreamMetadata, connections func(broker *Broker) int) (*Broker, error) {
+	brokers := metadata.brokers()
+	return brokers[randomIntn(len(brokers))], nil
+}
+
+// PlacementLeaderOnly chooses the leader
+func PlacementLeaderOnly(metadata *StreamMetadata, connections func(broker *Broker) int) (*Broker, error) {
+	return metadata.Leader, nil
+}
+
+// PlacementReplicasOnly chooses a random replica, to keep the consumers
+// off the leader. The leader is used only when the stream has no replicas.
+func PlacementReplicasOnly(metadata *StreamMetadata, connections func(broker *Broker) int) (*Broker, error) {
+	replicas := metadata.Replicas()
+	if len(replicas) == 0 {
+		return metadata.Leader, nil
+	}
+	return replicas[randomIntn(len(replicas))], nil
+}
+
+// PlacementLeastLoaded chooses the node with fewer consumer connections,
+// a random one among the nodes with the same load
+func PlacementLeastLoaded(metadata *StreamMetadata, connections func(broker *Broker) int) (*Broker, error) {
+	var candidates []*Broker
+	minConnections := -1
+	for _, broker := range metadata.brokers() {
+		count := connections(broker)
+		switch {
+		case minConnections < 0 || count < minConnections:
+			minConnections = count
+			candidates = []*Broker{broker}
+		case count == minConnections:
+			candidates = append(candidates, broker)
+		}
+	}
+	return candidates[randomIntn(len(candidates))], nil
+}
+
+// placeConsumer applies the policy to the stream metadata
+func placeConsumer(policy ConsumerPlacementPolicy, metadata *StreamMetadata,
+	connections func(broker *Broker) int) (*Broker, error) {
+	if metadata.responseCode != responseCodeOk {
+		return nil, newStreamError(metadata.responseCode, commandMetadata, metadata.stream)
+	}
+	if metadata.Leader == nil {
+		return nil, fmt.Errorf("leader error for stream for stream: %s", metadata.stream)
+	}
+	if policy == nil {
+		policy = PlacementRandom
+	}
+	broker, err := policy(metadata, connections)
+	if err != nil {
+		return nil, err
+	}
+	if broker == nil {
+		return nil, fmt.Errorf("no node chosen for the consumer of the stream: %s", metadata.stream)
+	}
+	return broker, nil
+}
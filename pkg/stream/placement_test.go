@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Consumer placement", func() {
+	leader := newBroker("node-0", "5552")
+	replicas := []*Broker{newBroker("node-1", "5552"), newBroker("node-2", "5552")}
+	metadata := StreamMetadata{}.New("placement", responseCodeOk, leader, replicas)
+	noConnections := func(broker *Broker) int { return 0 }
+
+	It("Leader only", func() {
+		for i := 0; i < 20; i++ {
+			broker, err := placeConsumer(PlacementLeaderOnly, metadata, noConnections)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(broker).To(Equal(leader))
+		}
+	})
+
+	It("Replicas only", func() {
+		for i := 0; i < 20; i++ {
+			broker, err := placeConsumer(PlacementReplicasOnly, metadata, noConnections)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(broker).NotTo(Equal(leader))
+			Expect(replicas).To(ContainElement(broker))
+		}
+		single := StreamMetadata{}.New("placement", responseCodeOk, leader, nil)
+		broker, err := placeConsumer(PlacementReplicasOnly, single, noConnections)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker).To(Equal(leader))
+	})
+
+	It("Random is the default", func() {
+		for i := 0; i < 20; i++ {
+			broker, err := placeConsumer(nil, metadata, noConnections)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.brokers()).To(ContainElement(broker))
+		}
+	})
+
+	It("Least loaded", func() {
+		connections := map[string]int{"node-0": 3, "node-1": 1, "node-2": 2}
+		broker, err := placeConsumer(PlacementLeastLoaded, metadata, func(broker *Broker) int {
+			return connections[broker.Host]
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker).To(Equal(replicas[0]))
+	})
+
+	It("Custom policy", func() {
+		zone := func(metadata *StreamMetadata, connections func(broker *Broker) int) (*Broker, error) {
+			for _, broker := range metadata.Replicas() {
+				if broker.Host == "node-2" {
+					return broker, nil
+				}
+			}
+			return nil, errors.New("no node in the zone")
+		}
+		broker, err := placeConsumer(zone, metadata, noConnections)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker).To(Equal(replicas[1]))
+
+		_, err = placeConsumer(zone, StreamMetadata{}.New("placement", responseCodeOk, leader, nil), noConnections)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Stream errors", func() {
+		_, err := placeConsumer(PlacementRandom,
+			StreamMetadata{}.New("placement", responseCodeStreamDoesNotExist, nil, nil), noConnections)
+		Expect(err).To(MatchError(StreamDoesNotExist))
+	})
+})
@@ -2,9 +2,11 @@ package stream
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/message"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,6 +18,11 @@ type UnConfirmedMessage struct {
 	SequenceID int64
 	Confirmed  bool
 	Err        error
+	addedAt    time.Time
+	// false while the message is in the producer queue
+	sent bool
+	// the size of the sent message
+	size int
 }
 
 type pendingMessagesSequence struct {
@@ -27,6 +34,17 @@ type messageSequence struct {
 	message      message.StreamMessage
 	size         int
 	publishingId int64
+	// set only when the producer uses the broker side filtering
+	filterValue *string
+}
+
+// entrySize is the space taken by the message inside a publish frame:
+// publishingId, filter value, message length and the message itself
+func (m messageSequence) entrySize() int {
+	if m.filterValue != nil {
+		return publishEntryHeaderSize + 2 + len(*m.filterValue) + m.size
+	}
+	return publishEntryHeaderSize + m.size
 }
 
 type Producer struct {
@@ -44,6 +62,23 @@ type Producer struct {
 	/// needed for the async publish
 	messageSequenceCh chan messageSequence
 	pendingMessages   pendingMessagesSequence
+	// the publish task sends the queued messages and
+	// closes the received channel, see drain
+	flushCh chan chan struct{}
+
+	// one slot for each unconfirmed message, nil when MaxInFlight is not set
+	inFlight chan struct{}
+	// closed with the producer, it releases the sends waiting for a slot
+	// and stops the publish task
+	closedCh chan struct{}
+	// held while sending on publishConfirm, so a slow reader
+	// doesn't block the producer mutex, see notifyConfirm
+	confirmMutex sync.Mutex
+	// not nil while the producer moves to the new leader,
+	// the sends wait until it is closed, see pause
+	resumeCh chan struct{}
+	// the publish frames being written, see beginWrite
+	writing int
 }
 
 type ProducerOptions struct {
@@ -51,7 +86,28 @@ type ProducerOptions struct {
 	streamName string
 	Name       string
 	QueueSize  int
-	BatchSize  int
+	// BatchSize is the max number of messages sent in a single publish frame
+	BatchSize int
+	// Linger is how long the first message of a batch waits for more messages
+	// before the batch is sent. Zero sends as soon as the queue is empty,
+	// NewProducerOptions sets 200ms, the fixed delay of the previous versions.
+	Linger time.Duration
+	// MaxBatchBytes caps the size of a publish frame, BatchSend splits the
+	// batch in more frames and a bigger message is refused by Send and
+	// BatchSend. Zero means the negotiated max frame size.
+	MaxBatchBytes int
+	// MaxInFlight is the max number of messages waiting for a confirmation.
+	// When it is reached Send blocks until some confirmations arrive.
+	// Zero means no limit.
+	MaxInFlight int
+	// ConfirmTimeout is how long a message waits for its confirmation.
+	// Expired messages are notified with Confirmed false and
+	// ConfirmationTimeout as Err. Zero means no timeout.
+	ConfirmTimeout time.Duration
+	// FilterValue extracts the value used by the broker side filtering.
+	// An empty value means the message has no filter value.
+	// When it is set the messages are sent with the publish v2 frame.
+	FilterValue func(message message.StreamMessage) string
 }
 
 func (po *ProducerOptions) SetProducerName(name string) *ProducerOptions {
@@ -69,10 +125,40 @@ func (po *ProducerOptions) SetBatchSize(size int) *ProducerOptions {
 	return po
 }
 
+func (po *ProducerOptions) SetLinger(linger time.Duration) *ProducerOptions {
+	po.Linger = linger
+	return po
+}
+
+func (po *ProducerOptions) SetMaxBatchBytes(maxBatchBytes int) *ProducerOptions {
+	po.MaxBatchBytes = maxBatchBytes
+	return po
+}
+
+func (po *ProducerOptions) SetMaxInFlight(maxInFlight int) *ProducerOptions {
+	po.MaxInFlight = maxInFlight
+	return po
+}
+
+func (po *ProducerOptions) SetConfirmTimeout(confirmTimeout time.Duration) *ProducerOptions {
+	po.ConfirmTimeout = confirmTimeout
+	return po
+}
+
+func (po *ProducerOptions) SetFilterValue(filterValue func(message message.StreamMessage) string) *ProducerOptions {
+	po.FilterValue = filterValue
+	return po
+}
+
+func (po *ProducerOptions) isFilterEnabled() bool {
+	return po.FilterValue != nil
+}
+
 func NewProducerOptions() *ProducerOptions {
 	return &ProducerOptions{
 		QueueSize: defaultQueuePublisherSize,
 		BatchSize: defaultBatchSize,
+		Linger:    defaultLinger,
 	}
 }
 
@@ -82,21 +168,68 @@ func (producer *Producer) GetUnConfirmed() map[int64]*UnConfirmedMessage {
 	return producer.unConfirmedMessages
 }
 
+// acquireInFlight waits for a free in-flight slot.
+// It must be followed by addUnConfirmed, that owns the slot.
+func (producer *Producer) acquireInFlight(ctx context.Context) error {
+	if producer.inFlight == nil {
+		return nil
+	}
+	select {
+	case producer.inFlight <- struct{}{}:
+		return nil
+	default:
+		producer.options.client.emit(LifecycleEvent{Type: EventProducerMaxInFlight,
+			StreamName: producer.GetStreamName(), Name: producer.GetName(),
+			Reason: "max in-flight messages reached"})
+	}
+	select {
+	case producer.inFlight <- struct{}{}:
+		return nil
+	case <-producer.closedCh:
+		return producer.closedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (producer *Producer) closedError() error {
+	return fmt.Errorf("producer id: %d closed", producer.ID)
+}
+
+func (producer *Producer) releaseInFlight() {
+	if producer.inFlight == nil {
+		return
+	}
+	select {
+	case <-producer.inFlight:
+	default:
+	}
+}
+
 func (producer *Producer) addUnConfirmed(sequence int64, message message.StreamMessage, producerID uint8) {
 	producer.mutex.Lock()
 	defer producer.mutex.Unlock()
+	if producer.unConfirmedMessages[sequence] != nil {
+		// same publishingId sent twice, the entry is replaced
+		// so the slot is not needed
+		producer.releaseInFlight()
+	}
 	producer.unConfirmedMessages[sequence] = &UnConfirmedMessage{
 		Message:    message,
 		ProducerID: producerID,
 		SequenceID: sequence,
 		Confirmed:  false,
+		addedAt:    time.Now(),
 	}
 }
 
 func (producer *Producer) removeUnConfirmed(sequence int64) {
 	producer.mutex.Lock()
 	defer producer.mutex.Unlock()
-	delete(producer.unConfirmedMessages, sequence)
+	if producer.unConfirmedMessages[sequence] != nil {
+		delete(producer.unConfirmedMessages, sequence)
+		producer.releaseInFlight()
+	}
 }
 
 func (producer *Producer) lenUnConfirmed() int {
@@ -111,6 +244,68 @@ func (producer *Producer) getUnConfirmed(sequence int64) *UnConfirmedMessage {
 	return producer.unConfirmedMessages[sequence]
 }
 
+// confirmUnConfirmed removes the confirmed message, it returns nil when
+// the message was already removed, for example by expireUnConfirmed
+func (producer *Producer) confirmUnConfirmed(sequence int64) *UnConfirmedMessage {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	msg := producer.unConfirmedMessages[sequence]
+	if msg == nil {
+		return nil
+	}
+	delete(producer.unConfirmedMessages, sequence)
+	producer.releaseInFlight()
+	msg.Confirmed = true
+	return msg
+}
+
+// notifyConfirm sends the messages to NotifyPublishConfirmation
+func (producer *Producer) notifyConfirm(messages []*UnConfirmedMessage) {
+	producer.confirmMutex.Lock()
+	defer producer.confirmMutex.Unlock()
+	if producer.publishConfirm != nil {
+		producer.publishConfirm <- messages
+	}
+}
+
+// expireUnConfirmed notifies the messages waiting for a confirmation
+// longer than ConfirmTimeout as not confirmed
+func (producer *Producer) expireUnConfirmed() {
+	producer.mutex.Lock()
+	var expired []*UnConfirmedMessage
+	for sequence, msg := range producer.unConfirmedMessages {
+		if time.Since(msg.addedAt) > producer.options.ConfirmTimeout {
+			msg.Confirmed = false
+			msg.Err = ConfirmationTimeout
+			expired = append(expired, msg)
+			delete(producer.unConfirmedMessages, sequence)
+			producer.releaseInFlight()
+		}
+	}
+	producer.mutex.Unlock()
+	if len(expired) > 0 {
+		logs.LogWarn("producer id: %d, %d messages not confirmed in %s",
+			producer.ID, len(expired), producer.options.ConfirmTimeout)
+		producer.notifyConfirm(expired)
+	}
+}
+
+func (producer *Producer) startConfirmTimeoutTask() {
+	if producer.options.ConfirmTimeout <= 0 {
+		return
+	}
+	go func() {
+		var ticker = time.NewTicker(producer.options.ConfirmTimeout / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if producer.getStatus() == closed {
+				return
+			}
+			producer.expireUnConfirmed()
+		}
+	}()
+}
+
 func (producer *Producer) NotifyPublishConfirmation() ChannelPublishConfirm {
 	ch := make(chan []*UnConfirmedMessage)
 	producer.publishConfirm = ch
@@ -140,6 +335,13 @@ func (producer *Producer) setStatus(status int) {
 	producer.mutex.Lock()
 	defer producer.mutex.Unlock()
 	producer.status = status
+	if status == closed && producer.closedCh != nil {
+		select {
+		case <-producer.closedCh:
+		default:
+			close(producer.closedCh)
+		}
+	}
 }
 
 func (producer *Producer) getStatus() int {
@@ -148,11 +350,165 @@ func (producer *Producer) getStatus() int {
 	return producer.status
 }
 
+// maxFrameSize is the max size of a publish frame, frame length included
+func (producer *Producer) maxFrameSize() int {
+	maxFrameSize := producer.options.client.getTuneState().requestedMaxFrameSize
+	if producer.options.MaxBatchBytes > 0 && producer.options.MaxBatchBytes < maxFrameSize {
+		return producer.options.MaxBatchBytes
+	}
+	return maxFrameSize
+}
+
+// pause holds the sends until resume
+func (producer *Producer) pause() {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	if producer.resumeCh == nil {
+		producer.resumeCh = make(chan struct{})
+	}
+}
+
+func (producer *Producer) resume() {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	if producer.resumeCh != nil {
+		close(producer.resumeCh)
+		producer.resumeCh = nil
+	}
+}
+
+// waitResume waits for resume, it returns when the producer
+// is closed or the context is done first
+func (producer *Producer) waitResume(ctx context.Context) error {
+	producer.mutex.Lock()
+	resumeCh := producer.resumeCh
+	producer.mutex.Unlock()
+	if resumeCh == nil {
+		return nil
+	}
+	select {
+	case <-resumeCh:
+		return nil
+	case <-producer.closedCh:
+		return producer.closedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginWrite waits for resume and counts the write in progress, so
+// waitSentConfirmed also waits for a write that passed the pause.
+// endWrite must follow.
+func (producer *Producer) beginWrite(ctx context.Context) error {
+	for {
+		if err := producer.waitResume(ctx); err != nil {
+			return err
+		}
+		producer.mutex.Lock()
+		if producer.resumeCh == nil {
+			producer.writing++
+			producer.mutex.Unlock()
+			return nil
+		}
+		// paused again in the meantime
+		producer.mutex.Unlock()
+	}
+}
+
+func (producer *Producer) endWrite() {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	producer.writing--
+}
+
+// resendUnConfirmed sends again the messages not confirmed,
+// in the same order, after the producer moved to the new leader
+func (producer *Producer) resendUnConfirmed() error {
+	producer.mutex.Lock()
+	unConfirmed := make([]*UnConfirmedMessage, 0, len(producer.unConfirmedMessages))
+	for _, msg := range producer.unConfirmedMessages {
+		// the messages still queued are sent by the publish task
+		if msg.sent {
+			unConfirmed = append(unConfirmed, msg)
+		}
+	}
+	producer.mutex.Unlock()
+	sort.Slice(unConfirmed, func(i, j int) bool {
+		return unConfirmed[i].SequenceID < unConfirmed[j].SequenceID
+	})
+
+	var batch []messageSequence
+	size := initBufferPublishSize
+	for _, msg := range unConfirmed {
+		msgBytes, err := msg.Message.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		sequence := producer.newMessageSequence(msg.Message, len(msgBytes))
+		sequence.publishingId = msg.SequenceID
+		if len(batch) > 0 && (len(batch) >= producer.options.BatchSize ||
+			frameLengthSize+size+sequence.entrySize() > producer.maxFrameSize()) {
+			if err := producer.internalBatchSend(batch); err != nil {
+				return err
+			}
+			batch = nil
+			size = initBufferPublishSize
+		}
+		batch = append(batch, sequence)
+		size += sequence.entrySize()
+	}
+	if len(batch) > 0 {
+		return producer.internalBatchSend(batch)
+	}
+	return nil
+}
+
+// closeAfterMetadataUpdate closes the producer that can't
+// move to the new leader, like Coordinator.RemoveProducerById
+func (producer *Producer) closeAfterMetadataUpdate(err error) {
+	producer.setStatus(closed)
+	producer.FlushUnConfirmedMessages()
+	reason := Event{
+		Command:    CommandMetadataUpdate,
+		StreamName: producer.GetStreamName(),
+		Name:       producer.GetName(),
+		Reason:     "Meta data update",
+		Err:        err,
+	}
+	producer.options.client.emit(LifecycleEvent{Type: EventProducerRemoved, StreamName: reason.StreamName,
+		Name: reason.Name, Reason: reason.Reason, Err: err})
+	if producer.closeHandler != nil {
+		producer.closeHandler <- reason
+	}
+	producer.closeNotifications()
+}
+
+// closeNotifications closes the channels of NotifyPublishConfirmation
+// and NotifyClose, the publish task stops with the closed status
+func (producer *Producer) closeNotifications() {
+	producer.confirmMutex.Lock()
+	defer producer.confirmMutex.Unlock()
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	if producer.publishConfirm != nil {
+		close(producer.publishConfirm)
+		producer.publishConfirm = nil
+	}
+	if producer.closeHandler != nil {
+		close(producer.closeHandler)
+		producer.closeHandler = nil
+	}
+}
+
 func (producer *Producer) sendBufferedMessages() {
 
 	if len(producer.pendingMessages.messages) > 0 {
-		//logs.LogInfo("len %d",  len(producer.pendingMessages.messages))
+		if producer.beginWrite(context.Background()) != nil {
+			// closed while paused
+			return
+		}
 		err := producer.internalBatchSend(producer.pendingMessages.messages)
+		producer.endWrite()
 		if err != nil {
 			return
 		}
@@ -162,30 +518,68 @@ func (producer *Producer) sendBufferedMessages() {
 }
 func (producer *Producer) startPublishTask() {
 	go func(ch chan messageSequence) {
-		var ticker = time.NewTicker(200 * time.Millisecond)
-		defer ticker.Stop()
+		// the linger timer is armed by the first message of a batch,
+		// so each batch waits at most options.Linger
+		var linger *time.Timer
+		var lingerCh <-chan time.Time
+		stopLinger := func() {
+			if linger != nil {
+				linger.Stop()
+			}
+			linger = nil
+			lingerCh = nil
+		}
+		defer stopLinger()
+
+		add := func(msg messageSequence) {
+			if frameLengthSize+producer.pendingMessages.size+msg.entrySize() > producer.maxFrameSize() {
+				producer.sendBufferedMessages()
+				stopLinger()
+			}
+
+			producer.pendingMessages.size += msg.entrySize()
+			producer.pendingMessages.messages = append(producer.pendingMessages.messages, msg)
+			if len(producer.pendingMessages.messages) >= producer.options.BatchSize ||
+				(producer.options.Linger <= 0 && len(ch) == 0) {
+				producer.sendBufferedMessages()
+				stopLinger()
+			} else if lingerCh == nil {
+				linger = time.NewTimer(producer.options.Linger)
+				lingerCh = linger.C
+			}
+		}
+
 		for {
 
 			select {
 
+			case <-producer.closedCh:
+				return
+
 			case msg, running := <-ch:
 				{
 					if !running {
 						return
 					}
-					if producer.pendingMessages.size+msg.size >= producer.options.client.getTuneState().requestedMaxFrameSize {
-						producer.sendBufferedMessages()
-					}
+					add(msg)
+				}
 
-					producer.pendingMessages.size += producer.pendingMessages.size + msg.size
-					producer.pendingMessages.messages = append(producer.pendingMessages.messages, msg)
-					if len(producer.pendingMessages.messages) >= producer.options.BatchSize {
-						producer.sendBufferedMessages()
+			case <-lingerCh:
+				producer.sendBufferedMessages()
+				linger = nil
+				lingerCh = nil
+
+			case done := <-producer.flushCh:
+				for len(ch) > 0 {
+					msg, running := <-ch
+					if !running {
+						break
 					}
+					add(msg)
 				}
-
-			case <-ticker.C:
 				producer.sendBufferedMessages()
+				stopLinger()
+				close(done)
 			}
 
 		}
@@ -193,30 +587,64 @@ func (producer *Producer) startPublishTask() {
 
 }
 
+// Send publishes the message. It blocks when the producer has
+// ProducerOptions.MaxInFlight messages waiting for a confirmation.
 func (producer *Producer) Send(message message.StreamMessage) error {
+	return producer.SendWithContext(context.Background(), message)
+}
+
+// SendWithContext is like Send, but it gives up waiting for a free
+// in-flight slot when the context is done, returning the context error.
+func (producer *Producer) SendWithContext(ctx context.Context, message message.StreamMessage) error {
+	switch producer.getStatus() {
+	case draining:
+		return ShuttingDown
+	case closed:
+		return producer.closedError()
+	}
+	if err := producer.waitResume(ctx); err != nil {
+		return err
+	}
 
 	msgBytes, err := message.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	if len(msgBytes)+initBufferPublishSize > producer.options.client.getTuneState().requestedMaxFrameSize {
+	msg := producer.newMessageSequence(message, len(msgBytes))
+	// a message must fit in a publish frame, MaxBatchBytes included
+	if frameLengthSize+initBufferPublishSize+msg.entrySize() > producer.maxFrameSize() {
 		return FrameTooLarge
 	}
-	sequence := producer.getPublishingID(message)
-	producer.addUnConfirmed(sequence, message, producer.ID)
-
-	if producer.getStatus() == closed {
-		return fmt.Errorf("producer id: %d  closed", producer.ID)
+	err = producer.acquireInFlight(ctx)
+	if err != nil {
+		return err
 	}
-
-	producer.messageSequenceCh <- messageSequence{
-		message:      message,
-		size:         len(msgBytes),
-		publishingId: sequence,
+	msg.publishingId = producer.getPublishingID(message)
+	producer.addUnConfirmed(msg.publishingId, message, producer.ID)
+
+	select {
+	case producer.messageSequenceCh <- msg:
+		return nil
+	case <-producer.closedCh:
+		producer.removeUnConfirmed(msg.publishingId)
+		return producer.closedError()
+	case <-ctx.Done():
+		producer.removeUnConfirmed(msg.publishingId)
+		return ctx.Err()
 	}
+}
 
-	return nil
+func (producer *Producer) newMessageSequence(message message.StreamMessage, size int) messageSequence {
+	msg := messageSequence{
+		message: message,
+		size:    size,
+	}
+	if producer.options.isFilterEnabled() {
+		filterValue := producer.options.FilterValue(message)
+		msg.filterValue = &filterValue
+	}
+	return msg
 }
 
 func (producer *Producer) getPublishingID(message message.StreamMessage) int64 {
@@ -227,47 +655,111 @@ func (producer *Producer) getPublishingID(message message.StreamMessage) int64 {
 	return sequence
 }
 
+// keepSequence restores the sequence when the one queried from the
+// server is behind it, the queued messages keep their publishing IDs
+func (producer *Producer) keepSequence(previous int64) {
+	if atomic.LoadInt64(&producer.sequence) < previous {
+		atomic.StoreInt64(&producer.sequence, previous)
+	}
+}
+
 func (producer *Producer) BatchSend(batchMessages []message.StreamMessage) error {
-	var messagesSequence = make([]messageSequence, len(batchMessages))
-	for i, batchMessage := range batchMessages {
+	switch producer.getStatus() {
+	case draining:
+		return ShuttingDown
+	case closed:
+		return producer.closedError()
+	}
+	if producer.options.MaxInFlight > 0 && len(batchMessages) > producer.options.MaxInFlight {
+		return fmt.Errorf("batch of %d messages is bigger than MaxInFlight %d",
+			len(batchMessages), producer.options.MaxInFlight)
+	}
+	var messagesSequence = make([]messageSequence, 0, len(batchMessages))
+	// the messages added are removed when the batch is not sent
+	removeAdded := func() {
+		for _, msg := range messagesSequence {
+			producer.removeUnConfirmed(msg.publishingId)
+		}
+	}
+	for _, batchMessage := range batchMessages {
 		messageBytes, err := batchMessage.MarshalBinary()
 		if err != nil {
-			return nil
+			removeAdded()
+			return err
 		}
-		sequence := producer.getPublishingID(batchMessage)
-		messagesSequence[i] = messageSequence{
-			message:      batchMessage,
-			size:         len(messageBytes),
-			publishingId: sequence,
+		msg := producer.newMessageSequence(batchMessage, len(messageBytes))
+		if frameLengthSize+initBufferPublishSize+msg.entrySize() > producer.maxFrameSize() {
+			removeAdded()
+			return FrameTooLarge
 		}
-		producer.addUnConfirmed(sequence, batchMessage, producer.ID)
+		err = producer.acquireInFlight(context.Background())
+		if err != nil {
+			removeAdded()
+			return err
+		}
+		msg.publishingId = producer.getPublishingID(batchMessage)
+		producer.addUnConfirmed(msg.publishingId, batchMessage, producer.ID)
+		messagesSequence = append(messagesSequence, msg)
 	}
 
-	return producer.internalBatchSend(messagesSequence)
+	if err := producer.beginWrite(context.Background()); err != nil {
+		removeAdded()
+		return err
+	}
+	err := producer.sendInFrames(messagesSequence)
+	producer.endWrite()
+	if err != nil {
+		removeAdded()
+		return err
+	}
+	return nil
+}
+
+// sendInFrames sends the messages in publish frames of at most maxFrameSize
+func (producer *Producer) sendInFrames(messagesSequence []messageSequence) error {
+	start, size := 0, initBufferPublishSize
+	for i, msg := range messagesSequence {
+		if i > start && frameLengthSize+size+msg.entrySize() > producer.maxFrameSize() {
+			if err := producer.internalBatchSend(messagesSequence[start:i]); err != nil {
+				return err
+			}
+			start, size = i, initBufferPublishSize
+		}
+		size += msg.entrySize()
+	}
+	return producer.internalBatchSend(messagesSequence[start:])
 }
 
 func (producer *Producer) internalBatchSend(messagesSequence []messageSequence) error {
 	if producer.getStatus() == closed {
-		return fmt.Errorf("producer id: %d closed", producer.ID)
+		return producer.closedError()
 	}
 
 	var msgLen int
 	for _, msg := range messagesSequence {
-		msgLen += msg.size + 8 + 4
+		msgLen += msg.entrySize()
 	}
 
 	frameHeaderLength := initBufferPublishSize
 	length := frameHeaderLength + msgLen
 	publishId := producer.ID
 	var b = bytes.NewBuffer(make([]byte, 0, length+4))
-	writeProtocolHeader(b, length, commandPublish)
+	if producer.options.isFilterEnabled() {
+		// the filter value is part of the publish v2 frame
+		writeVersionedProtocolHeader(b, length, commandPublish, version2)
+	} else {
+		writeProtocolHeader(b, length, commandPublish)
+	}
 	writeByte(b, publishId)
 	writeInt(b, len(messagesSequence)) //toExcluded - fromInclude
 
 	for _, msg := range messagesSequence {
 		r, _ := msg.message.MarshalBinary()
 		writeLong(b, msg.publishingId) // publishingId
-		writeInt(b, len(r))            // len
+		if msg.filterValue != nil {
+			writeNullableString(b, *msg.filterValue)
+		}
+		writeInt(b, len(r)) // len
 		b.Write(r)
 	}
 
@@ -286,19 +778,114 @@ func (producer *Producer) internalBatchSend(messagesSequence []messageSequence)
 
 		return err
 	}
+	producer.markSent(messagesSequence)
 	return nil
 }
 
+func (producer *Producer) markSent(messagesSequence []messageSequence) {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	for _, msg := range messagesSequence {
+		if unConfirmed := producer.unConfirmedMessages[msg.publishingId]; unConfirmed != nil {
+			unConfirmed.sent = true
+			unConfirmed.size = msg.size
+		}
+	}
+}
+
+// waitSentConfirmed waits the writes in progress and the confirmations
+// of the messages already sent, the producer is paused so no new
+// messages are sent
+func (producer *Producer) waitSentConfirmed(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		producer.mutex.Lock()
+		sent := producer.writing
+		for _, msg := range producer.unConfirmedMessages {
+			if msg.sent {
+				sent++
+			}
+		}
+		producer.mutex.Unlock()
+		if sent == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pendingBytes is the size of the messages sent and
+// waiting for a confirmation, see NewLeastBusyStrategy
+func (producer *Producer) pendingBytes() int {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	pending := 0
+	for _, msg := range producer.unConfirmedMessages {
+		pending += msg.size
+	}
+	return pending
+}
+
 func (producer *Producer) FlushUnConfirmedMessages() {
+	producer.confirmMutex.Lock()
+	defer producer.confirmMutex.Unlock()
 	producer.mutex.Lock()
+	var flushed []*UnConfirmedMessage
 	if producer.publishConfirm != nil {
 		for _, msg := range producer.unConfirmedMessages {
 			msg.Confirmed = false
-			producer.publishConfirm <- []*UnConfirmedMessage{msg}
+			flushed = append(flushed, msg)
 			delete(producer.unConfirmedMessages, msg.SequenceID)
+			producer.releaseInFlight()
 		}
 	}
 	producer.mutex.Unlock()
+	for _, msg := range flushed {
+		producer.publishConfirm <- []*UnConfirmedMessage{msg}
+	}
+}
+
+// drain refuses new messages, sends the queued ones and waits
+// for their confirmations, then closes the producer.
+// When the context is done first the producer is closed anyway,
+// the messages still unconfirmed are in GetUnConfirmed.
+func (producer *Producer) drain(ctx context.Context) error {
+	if producer.getStatus() != open {
+		return AlreadyClosed
+	}
+	producer.setStatus(draining)
+
+	done := make(chan struct{})
+	select {
+	case producer.flushCh <- done:
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+
+	var ticker = time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for producer.lenUnConfirmed() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	if err := producer.Close(); err != nil {
+		return err
+	}
+	if producer.lenUnConfirmed() > 0 {
+		logs.LogWarn("producer id: %d closed with %d messages not confirmed",
+			producer.ID, producer.lenUnConfirmed())
+		return ctx.Err()
+	}
+	return nil
 }
 
 func (producer *Producer) Close() error {
@@ -328,18 +915,7 @@ func (producer *Producer) Close() error {
 		close(ch)
 	}
 
-	producer.mutex.Lock()
-	if producer.publishConfirm != nil {
-		close(producer.publishConfirm)
-		producer.publishConfirm = nil
-	}
-	if producer.closeHandler != nil {
-		close(producer.closeHandler)
-		producer.closeHandler = nil
-	}
-	close(producer.messageSequenceCh)
-
-	producer.mutex.Unlock()
+	producer.closeNotifications()
 
 	return nil
 }
@@ -359,15 +935,7 @@ func (producer *Producer) GetName() string {
 }
 
 func (c *Client) deletePublisher(publisherId byte) error {
-	length := 2 + 2 + 4 + 1
-	resp := c.coordinator.NewResponse(CommandDeletePublisher)
-	correlationId := resp.correlationid
-	var b = bytes.NewBuffer(make([]byte, 0, length+4))
-	writeProtocolHeader(b, length, CommandDeletePublisher,
-		correlationId)
-
-	writeByte(b, publisherId)
-	errWrite := c.handleWrite(b.Bytes(), resp)
+	errWrite := c.unregisterPublisher(publisherId)
 
 	err := c.coordinator.RemoveProducerById(publisherId, Event{
 		Command: CommandDeletePublisher,
@@ -378,5 +946,19 @@ func (c *Client) deletePublisher(publisherId byte) error {
 		logs.LogWarn("producer id: %d already removed", publisherId)
 	}
 
-	return errWrite.Err
+	return errWrite
+}
+
+// unregisterPublisher sends the delete publisher command,
+// the producer is not removed from the coordinator
+func (c *Client) unregisterPublisher(publisherId byte) error {
+	length := 2 + 2 + 4 + 1
+	resp := c.coordinator.NewResponse(CommandDeletePublisher)
+	correlationId := resp.correlationid
+	var b = bytes.NewBuffer(make([]byte, 0, length+4))
+	writeProtocolHeader(b, length, CommandDeletePublisher,
+		correlationId)
+
+	writeByte(b, publisherId)
+	return c.handleWrite(b.Bytes(), resp).Err
 }
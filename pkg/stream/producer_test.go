@@ -1,6 +1,9 @@
 package stream
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"github.com/google/uuid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -72,7 +75,7 @@ var _ = Describe("Streaming Producers", func() {
 	It("Not found NotExistingStream", func() {
 		_, err := testEnvironment.NewProducer("notExistingStream", nil)
 		Expect(err).
-			To(Equal(StreamDoesNotExist))
+			To(MatchError(StreamDoesNotExist))
 	})
 
 	It("Send Confirmation", func() {
@@ -234,6 +237,104 @@ var _ = Describe("Streaming Producers", func() {
 
 	})
 
+	It("Linger/MaxBatchBytes", func() {
+		producer, err := testEnvironment.NewProducer(testProducerStream,
+			NewProducerOptions().SetLinger(0).SetMaxBatchBytes(1024))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.maxFrameSize()).To(Equal(1024))
+		var messagesCount int32
+		chConfirm := producer.NotifyPublishConfirmation()
+		go func(ch ChannelPublishConfirm) {
+			for ids := range ch {
+				atomic.AddInt32(&messagesCount, int32(len(ids)))
+			}
+		}(chConfirm)
+
+		for z := 0; z < 20; z++ {
+			s := make([]byte, 300)
+			err = producer.Send(amqp.NewMessage(s))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		time.Sleep(300 * time.Millisecond)
+		Expect(atomic.LoadInt32(&messagesCount)).To(Equal(int32(20)))
+		// smaller than the frame size, bigger than MaxBatchBytes
+		Expect(producer.Send(amqp.NewMessage(make([]byte, 2048)))).To(Equal(FrameTooLarge))
+
+		// BatchSend splits the batch at MaxBatchBytes
+		var batch []message.StreamMessage
+		for z := 0; z < 20; z++ {
+			batch = append(batch, amqp.NewMessage(make([]byte, 300)))
+		}
+		Expect(producer.BatchSend(batch)).NotTo(HaveOccurred())
+		Eventually(func() int32 { return atomic.LoadInt32(&messagesCount) }, time.Second).
+			Should(Equal(int32(40)))
+		Expect(producer.BatchSend([]message.StreamMessage{amqp.NewMessage(make([]byte, 2048))})).
+			To(Equal(FrameTooLarge))
+		Expect(producer.lenUnConfirmed()).To(Equal(0))
+		err = producer.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("MaxInFlight", func() {
+		producer, err := testEnvironment.NewProducer(testProducerStream,
+			NewProducerOptions().SetMaxInFlight(10))
+		Expect(err).NotTo(HaveOccurred())
+		var messagesCount int32
+		chConfirm := producer.NotifyPublishConfirmation()
+		go func(ch ChannelPublishConfirm) {
+			for ids := range ch {
+				atomic.AddInt32(&messagesCount, int32(len(ids)))
+			}
+		}(chConfirm)
+
+		for z := 0; z < 100; z++ {
+			err = producer.Send(amqp.NewMessage([]byte("in flight")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(producer.lenUnConfirmed()).To(BeNumerically("<=", 10))
+		}
+
+		err = producer.BatchSend(CreateArrayMessagesForTesting(11))
+		Expect(err).To(HaveOccurred())
+
+		time.Sleep(500 * time.Millisecond)
+		Expect(atomic.LoadInt32(&messagesCount)).To(Equal(int32(100)))
+		err = producer.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("MaxInFlight SendWithContext", func() {
+		producer, err := testEnvironment.NewProducer(testProducerStream,
+			NewProducerOptions().SetMaxInFlight(1).SetLinger(time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		err = producer.Send(amqp.NewMessage([]byte("in flight")))
+		Expect(err).NotTo(HaveOccurred())
+		// the first message is still lingering, so there is no slot
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = producer.SendWithContext(ctx, amqp.NewMessage([]byte("in flight")))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		err = producer.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("MaxInFlight Close releases the waiting sends", func() {
+		producer, err := testEnvironment.NewProducer(testProducerStream,
+			NewProducerOptions().SetMaxInFlight(1).SetLinger(time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.Send(amqp.NewMessage([]byte("in flight")))).NotTo(HaveOccurred())
+		sendErr := make(chan error, 1)
+		go func() {
+			sendErr <- producer.Send(amqp.NewMessage([]byte("waiting")))
+		}()
+		Consistently(sendErr, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(producer.Close()).NotTo(HaveOccurred())
+		Eventually(sendErr, time.Second).Should(Receive(HaveOccurred()))
+		Expect(producer.Send(amqp.NewMessage([]byte("closed")))).To(HaveOccurred())
+		Expect(producer.BatchSend([]message.StreamMessage{amqp.NewMessage([]byte("closed"))})).To(HaveOccurred())
+		// only the first message is waiting for a confirmation
+		Expect(producer.lenUnConfirmed()).To(BeNumerically("<=", 1))
+	})
+
 	It("Smart Send send after", func() {
 		// this test is need to test the send after
 		// and the time check
@@ -298,8 +399,148 @@ var _ = Describe("Streaming Producers", func() {
 		})
 		Expect(err).To(HaveOccurred())
 
+		_, err = env.NewProducer(testProducerStream, NewProducerOptions().SetLinger(-1))
+		Expect(err).To(HaveOccurred())
+
+		_, err = env.NewProducer(testProducerStream, NewProducerOptions().SetMaxBatchBytes(-1))
+		Expect(err).To(HaveOccurred())
+
+		_, err = env.NewProducer(testProducerStream, NewProducerOptions().SetMaxInFlight(-1))
+		Expect(err).To(HaveOccurred())
+
+		_, err = env.NewProducer(testProducerStream, NewProducerOptions().SetConfirmTimeout(time.Millisecond))
+		Expect(err).To(HaveOccurred())
+
 		err = env.Close()
 		Expect(err).NotTo(HaveOccurred())
 	})
 
 })
+
+var _ = Describe("Producer confirm timeout", func() {
+
+	It("ConfirmTimeout expires unconfirmed messages", func() {
+		client := newClient("test-client", nil)
+		producer, err := client.coordinator.NewProducer(NewProducerOptions().
+			SetConfirmTimeout(200 * time.Millisecond).SetMaxInFlight(2))
+		Expect(err).NotTo(HaveOccurred())
+		chConfirm := producer.NotifyPublishConfirmation()
+		Expect(producer.acquireInFlight(context.Background())).NotTo(HaveOccurred())
+		producer.addUnConfirmed(1, amqp.NewMessage([]byte("expire")), producer.ID)
+		time.Sleep(300 * time.Millisecond)
+		go producer.expireUnConfirmed()
+		expired := <-chConfirm
+		Expect(len(expired)).To(Equal(1))
+		Expect(expired[0].Confirmed).To(BeFalse())
+		Expect(expired[0].Err).To(Equal(ConfirmationTimeout))
+		Expect(producer.lenUnConfirmed()).To(Equal(0))
+		Expect(len(producer.inFlight)).To(Equal(0))
+		// the late confirmation doesn't report the message again
+		Expect(producer.confirmUnConfirmed(1)).To(BeNil())
+		Expect(expired[0].Confirmed).To(BeFalse())
+	})
+
+	It("A producer closed by a metadata update releases its channels", func() {
+		client := newClient("test-client", nil)
+		producer, err := client.coordinator.NewProducer(NewProducerOptions())
+		Expect(err).NotTo(HaveOccurred())
+		producer.startPublishTask()
+		chConfirm := producer.NotifyPublishConfirmation()
+		chClose := producer.NotifyClose()
+		producer.pause()
+		producer.closeAfterMetadataUpdate(StreamDoesNotExist)
+		Eventually(chConfirm).Should(BeClosed())
+		Expect((<-chClose).Err).To(Equal(StreamDoesNotExist))
+		Expect(producer.closedCh).To(BeClosed())
+		Expect(producer.waitResume(context.Background())).To(HaveOccurred())
+	})
+
+	It("A slow reader doesn't hold the producer", func() {
+		client := newClient("test-client", nil)
+		producer, err := client.coordinator.NewProducer(NewProducerOptions().
+			SetConfirmTimeout(200 * time.Millisecond))
+		Expect(err).NotTo(HaveOccurred())
+		chConfirm := producer.NotifyPublishConfirmation()
+		producer.addUnConfirmed(1, amqp.NewMessage([]byte("expire")), producer.ID)
+		time.Sleep(300 * time.Millisecond)
+		go producer.expireUnConfirmed()
+		// nobody reads chConfirm yet
+		Eventually(producer.lenUnConfirmed).Should(Equal(0))
+		producer.addUnConfirmed(2, amqp.NewMessage([]byte("next")), producer.ID)
+		Expect(producer.lenUnConfirmed()).To(Equal(1))
+		Expect(<-chConfirm).To(HaveLen(1))
+	})
+
+})
+
+var _ = Describe("Producer migration", func() {
+
+	It("Pause holds the sends", func() {
+		client := newClient("test-client", nil)
+		producer, err := client.coordinator.NewProducer(NewProducerOptions())
+		Expect(err).NotTo(HaveOccurred())
+		producer.pause()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(producer.SendWithContext(ctx, amqp.NewMessage([]byte("paused")))).
+			To(Equal(context.DeadlineExceeded))
+		producer.resume()
+		Expect(producer.waitResume(context.Background())).NotTo(HaveOccurred())
+	})
+
+	It("Move the producer after a metadata update", func() {
+		env, err := NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		events, unsubscribe := env.Events()
+		defer unsubscribe()
+		streamName := uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+		producer, err := env.NewProducer(streamName, NewProducerOptions().SetProducerName("migration"))
+		Expect(err).NotTo(HaveOccurred())
+		var confirmed int32
+		chConfirm := producer.NotifyPublishConfirmation()
+		go func(ch ChannelPublishConfirm) {
+			for ids := range ch {
+				for _, msg := range ids {
+					if msg.Confirmed {
+						atomic.AddInt32(&confirmed, 1)
+					}
+				}
+			}
+		}(chConfirm)
+
+		By("the server removes the publisher")
+		client := producer.options.client
+		resp := client.coordinator.NewResponse(CommandDeletePublisher)
+		var b = bytes.NewBuffer(make([]byte, 0, 2+2+4+1+4))
+		writeProtocolHeader(b, 2+2+4+1, CommandDeletePublisher, resp.correlationid)
+		writeByte(b, producer.ID)
+		Expect(client.handleWrite(b.Bytes(), resp).Err).NotTo(HaveOccurred())
+		// the IDs of messages not stored by the server
+		sequence := atomic.AddInt64(&producer.sequence, 100)
+
+		By("the server sends the metadata update")
+		var update = bytes.NewBuffer(make([]byte, 0, 2+2+len(streamName)))
+		writeUShort(update, responseCodeStreamNotAvailable)
+		writeString(update, streamName)
+		client.metadataUpdateFrameHandler(bufio.NewReader(update))
+		Eventually(events, 5*time.Second).Should(Receive(WithTransform(func(event LifecycleEvent) LifecycleEventType {
+			return event.Type
+		}, Equal(EventProducerMigrated))))
+
+		Expect(producer.getStatus()).To(Equal(open))
+		// not moved back to the sequence of the new leader
+		Expect(atomic.LoadInt64(&producer.sequence)).To(Equal(sequence))
+		for i := 0; i < 10; i++ {
+			Expect(producer.Send(amqp.NewMessage([]byte("migrated")))).NotTo(HaveOccurred())
+		}
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&confirmed)
+		}, 5*time.Second).Should(Equal(int32(10)))
+
+		Expect(producer.Close()).NotTo(HaveOccurred())
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+	})
+
+})
@@ -8,6 +8,7 @@ import (
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/logs"
 	"hash/crc32"
 	"io"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,7 +30,7 @@ func (c *Client) handleResponse() {
 		frameLen, err := readUInt(buffer)
 		if err != nil {
 			logs.LogDebug("socket error: %s", err)
-			_ = c.Close()
+			_ = c.closeWithReason("socket error", err)
 			break
 		}
 		c.lastHeartBeat = time.Now()
@@ -108,6 +109,14 @@ func (c *Client) handleResponse() {
 			{
 				c.closeFrameHandler(readerProtocol, buffer)
 			}
+		case commandExchangeVersion:
+			{
+				c.handleExchangeVersionResponse(readerProtocol, buffer)
+			}
+		case commandStreamStats:
+			{
+				c.streamStatsFrameHandler(readerProtocol, buffer)
+			}
 		default:
 			{
 				logs.LogWarn("Command not implemented %d buff:%d \n", readerProtocol.CommandID, buffer.Buffered())
@@ -155,6 +164,7 @@ func (c *Client) handlePeerProperties(readProtocol *ReaderProtocol, r *bufio.Rea
 		return
 	}
 	res.code <- Code{id: readProtocol.ResponseCode}
+	res.data <- serverProperties
 
 }
 
@@ -163,23 +173,20 @@ func (c *Client) handleTune(r *bufio.Reader) interface{} {
 	serverMaxFrameSize, _ := readUInt(r)
 	serverHeartbeat, _ := readUInt(r)
 
-	maxFrameSize := serverMaxFrameSize
-	heartbeat := serverHeartbeat
+	tuneState := TuneState{
+		requestedMaxFrameSize: negotiateTuneValue(c.clientTuneState.requestedMaxFrameSize,
+			int(serverMaxFrameSize)),
+		requestedHeartbeat: negotiateTuneValue(c.clientTuneState.requestedHeartbeat,
+			int(serverHeartbeat)),
+	}
 
-	length := 2 + 2 + 4 + 4
-	var b = bytes.NewBuffer(make([]byte, 0, length+4))
-	writeInt(b, length)
-	writeUShort(b, uShortEncodeResponseCode(commandTune))
-	writeShort(b, version1)
-	writeUInt(b, maxFrameSize)
-	writeUInt(b, heartbeat)
 	res, err := c.coordinator.GetResponseByName("tune")
 	if err != nil {
 		// TODO handle response
 		return err
 	}
-	res.data <- b.Bytes()
-	return b.Bytes()
+	res.data <- tuneState
+	return tuneState
 
 }
 
@@ -228,20 +235,17 @@ func (c *Client) handleConfirm(readProtocol *ReaderProtocol, r *bufio.Reader) in
 	}
 	var unConfirmed []*UnConfirmedMessage
 	for publishingIdCount != 0 {
-		m := producer.getUnConfirmed(readInt64(r))
+		// only the first to remove the message reports it
+		m := producer.confirmUnConfirmed(readInt64(r))
 		if m != nil {
-			m.Confirmed = true
 			unConfirmed = append(unConfirmed, m)
-			producer.removeUnConfirmed(m.SequenceID)
 		}
 		publishingIdCount--
 	}
 
-	producer.mutex.Lock()
-	if producer.publishConfirm != nil {
-		producer.publishConfirm <- unConfirmed
+	if len(unConfirmed) > 0 {
+		producer.notifyConfirm(unConfirmed)
 	}
-	producer.mutex.Unlock()
 
 	return 0
 }
@@ -277,13 +281,15 @@ func (c *Client) handleDeliver(r *bufio.Reader) {
 
 	_ = readUShort(r)
 	numRecords, _ := readUInt(r)
-	_ = readInt64(r)       // timestamp
+	chunkTimestamp := readInt64(r)
 	_ = readInt64(r)       // epoch, unsigned long
 	offset := readInt64(r) // offset position
 	crc, _ := readUInt(r)  /// crc and dataLength are needed to calculate the CRC
 	dataLength, _ := readUInt(r)
 	_, _ = readUInt(r)
 	_, _ = readUInt(r)
+	// the offset is moved by the records
+	chunkId := offset
 
 	if len(c.plainCRCBuffer) < int(dataLength) {
 		c.plainCRCBuffer = make([]byte, dataLength)
@@ -298,9 +304,11 @@ func (c *Client) handleDeliver(r *bufio.Reader) {
 	}
 
 	filter := offsetLimit != -1
+	// the messages after ConsumerOptions.Until are not delivered
+	untilReached := atomic.LoadInt32(&consumer.untilReached) == 1
 
 	//messages
-	var batchConsumingMessages []*amqp.Message
+	var batchConsumingMessages []offsetMessage
 	position := 0
 
 	for numRecords != 0 {
@@ -324,13 +332,21 @@ func (c *Client) handleDeliver(r *bufio.Reader) {
 
 			if filter && (offset < offsetLimit) {
 				/// TODO set recordset as filtered
+			} else if untilReached || consumer.options.beyondUntil(offset, chunkTimestamp) {
+				// after the Until bound
 			} else {
 				msg := &amqp.Message{}
 				err := msg.UnmarshalBinary(arrayMessage)
 				if err != nil {
 					logs.LogError("error unmarshal messages: %s", err)
 				}
-				batchConsumingMessages = append(batchConsumingMessages, msg)
+				if consumer.options.accept(msg) {
+					batchConsumingMessages = append(batchConsumingMessages, offsetMessage{
+						message:        msg,
+						offset:         offset,
+						chunkTimestamp: chunkTimestamp,
+					})
+				}
 			}
 
 		} else {
@@ -347,9 +363,25 @@ func (c *Client) handleDeliver(r *bufio.Reader) {
 		panic("Error during CRC")
 	} /// ???
 	//
-	if consumer.getStatus() == open {
+	if consumer.getStatus() == open && !untilReached {
+		reached := consumer.options.beyondUntil(offset, chunkTimestamp) ||
+			consumer.options.atTail(chunkId)
+		if reached && consumer.options.Until.isOffset() {
+			offset = consumer.options.Until.offset + 1
+		} else if reached && consumer.options.Until.isTimestamp() &&
+			consumer.options.beyondUntil(chunkId, chunkTimestamp) {
+			// the chunk is not delivered, the stored offset stays before it
+			offset = chunkId
+		}
+		if consumer.lastN != nil {
+			batchConsumingMessages = consumer.lastN.add(chunkId, batchConsumingMessages)
+		}
+		atomic.AddInt32(&consumer.pendingChunks, 1)
 		consumer.response.data <- offset
 		consumer.response.messages <- batchConsumingMessages
+		if reached && atomic.CompareAndSwapInt32(&consumer.untilReached, 0, 1) {
+			go consumer.closeAtUntil()
+		}
 	}
 
 }
@@ -387,16 +419,17 @@ func (c *Client) handlePublishError(buffer *bufio.Reader) {
 			logs.LogWarn("producer not found :%s", err)
 			producer = &Producer{unConfirmedMessages: map[int64]*UnConfirmedMessage{}}
 		} else {
+			unConfirmed := producer.getUnConfirmed(publishingId)
 			producer.mutex.Lock()
 			if producer.publishError != nil {
 				producer.publishError <- PublishError{
 					Code:               code,
-					Err:                lookErrorCode(code),
-					UnConfirmedMessage: producer.getUnConfirmed(publishingId),
+					Err:                newStreamError(code, commandPublish, producer.GetStreamName()),
+					UnConfirmedMessage: unConfirmed,
 				}
 			}
-			producer.removeUnConfirmed(publishingId)
 			producer.mutex.Unlock()
+			producer.removeUnConfirmed(publishingId)
 		}
 		publishingErrorCount--
 	}
@@ -408,10 +441,14 @@ func (c *Client) metadataUpdateFrameHandler(buffer *bufio.Reader) {
 	if code == responseCodeStreamNotAvailable {
 		stream := readString(buffer)
 		logs.LogDebug("stream %s is no longer available", stream)
+		c.emit(LifecycleEvent{Type: EventMetadataUpdate, StreamName: stream,
+			Reason: "stream not available", Err: newStreamError(code, CommandMetadataUpdate, stream)})
 		c.mutex.Lock()
-		c.metadataListener <- metaDataUpdateEvent{
-			StreamName: stream,
-			code:       responseCodeStreamNotAvailable,
+		if c.metadataListener != nil {
+			c.metadataListener <- metaDataUpdateEvent{
+				StreamName: stream,
+				code:       responseCodeStreamNotAvailable,
+			}
 		}
 		c.mutex.Unlock()
 
@@ -0,0 +1,63 @@
+package stream
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ServerInfo describes the server a connection is attached to.
+// Properties are the server peer properties and ConnectionProperties
+// the properties returned by the open command.
+type ServerInfo struct {
+	Product              string
+	Version              string
+	Platform             string
+	ClusterName          string
+	AdvertisedHost       string
+	AdvertisedPort       string
+	Properties           map[string]string
+	ConnectionProperties map[string]string
+}
+
+func newServerInfo(serverProperties map[string]string, connectionProperties map[string]string) *ServerInfo {
+	info := &ServerInfo{
+		Product:              serverProperties["product"],
+		Version:              serverProperties["version"],
+		Platform:             serverProperties["platform"],
+		ClusterName:          serverProperties["cluster_name"],
+		AdvertisedHost:       connectionProperties["advertised_host"],
+		AdvertisedPort:       connectionProperties["advertised_port"],
+		Properties:           map[string]string{},
+		ConnectionProperties: map[string]string{},
+	}
+	for k, v := range serverProperties {
+		info.Properties[k] = v
+	}
+	for k, v := range connectionProperties {
+		info.ConnectionProperties[k] = v
+	}
+	return info
+}
+
+// VersionAtLeast tells if the server version is major.minor or newer
+func (s *ServerInfo) VersionAtLeast(major int, minor int) bool {
+	return versionAtLeast(s.Version, major, minor)
+}
+
+// versionAtLeast compares a server version like 3.13.0 or 3.13.0-rc.1
+// with major.minor, an unknown format is considered older
+func versionAtLeast(version string, major int, minor int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	versionMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	versionMinor, err := strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0])
+	if err != nil {
+		return false
+	}
+	return versionMajor > major || (versionMajor == major && versionMinor >= minor)
+}
@@ -0,0 +1,36 @@
+package stream
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server info", func() {
+
+	It("From server and connection properties", func() {
+		info := newServerInfo(map[string]string{
+			"product":      "RabbitMQ",
+			"version":      "3.13.1",
+			"platform":     "Erlang/OTP 26",
+			"cluster_name": "rabbit@eu-1",
+		}, map[string]string{
+			"advertised_host": "eu-1.local",
+			"advertised_port": "5552",
+		})
+		Expect(info.Product).To(Equal("RabbitMQ"))
+		Expect(info.Version).To(Equal("3.13.1"))
+		Expect(info.Platform).To(Equal("Erlang/OTP 26"))
+		Expect(info.ClusterName).To(Equal("rabbit@eu-1"))
+		Expect(info.AdvertisedHost).To(Equal("eu-1.local"))
+		Expect(info.AdvertisedPort).To(Equal("5552"))
+		Expect(info.VersionAtLeast(3, 13)).To(BeTrue())
+		Expect(info.VersionAtLeast(3, 14)).To(BeFalse())
+		Expect(info.VersionAtLeast(4, 0)).To(BeFalse())
+	})
+
+	It("Not connected client", func() {
+		client := newClient("test-client", nil)
+		Expect(client.ServerInfo()).To(BeNil())
+	})
+
+})
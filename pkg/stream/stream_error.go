@@ -0,0 +1,64 @@
+package stream
+
+import "fmt"
+
+// StreamError is an error response from the server.
+// errors.Is matches the sentinel error of the Code, for example:
+//
+//	errors.Is(err, StreamNotAvailable)
+//
+// errors.As gives access to the details
+type StreamError struct {
+	Code    uint16
+	Command string
+	Stream  string
+	// the sentinel error of the Code
+	err error
+}
+
+func newStreamError(code uint16, command uint16, stream string) *StreamError {
+	return &StreamError{
+		Code:    code,
+		Command: lookUpCommand(command),
+		Stream:  stream,
+		err:     lookErrorCode(code),
+	}
+}
+
+func (e *StreamError) Error() string {
+	if e.Stream == "" {
+		return fmt.Sprintf("%s, code: %d, command: %s", e.Unwrap(), e.Code, e.Command)
+	}
+	return fmt.Sprintf("%s, code: %d, command: %s, stream: %s", e.Unwrap(), e.Code, e.Command, e.Stream)
+}
+
+// Unwrap returns the sentinel error of the Code
+func (e *StreamError) Unwrap() error {
+	return e.err
+}
+
+// Cause is the github.com/pkg/errors equivalent of Unwrap
+func (e *StreamError) Cause() error {
+	return e.Unwrap()
+}
+
+// Retryable is true when the same operation can succeed later,
+// for example when the stream leader is not elected yet
+func (e *StreamError) Retryable() bool {
+	switch e.Code {
+	case responseCodeStreamNotAvailable, responseCodeInternalError:
+		return true
+	}
+	return false
+}
+
+// commandTargetsStream is true when the info of the
+// command response is the stream name
+func commandTargetsStream(command uint16) bool {
+	switch command {
+	case commandCreateStream, commandDeleteStream, commandDeclarePublisher, commandSubscribe, commandMetadata,
+		commandStreamStats:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pkgerrors "github.com/pkg/errors"
+)
+
+var _ = Describe("Stream errors", func() {
+
+	It("Match the sentinel errors", func() {
+		var err error = newStreamError(responseCodeStreamNotAvailable, commandDeclarePublisher, "orders")
+		Expect(errors.Is(err, StreamNotAvailable)).To(BeTrue())
+		Expect(errors.Is(err, StreamDoesNotExist)).To(BeFalse())
+		Expect(pkgerrors.Cause(err)).To(Equal(StreamNotAvailable))
+		Expect(err.Error()).To(Equal("Stream Not Available, code: 6, command: CommandDeclarePublisher, stream: orders"))
+
+		var streamError *StreamError
+		Expect(errors.As(fmt.Errorf("wrapped: %w", err), &streamError)).To(BeTrue())
+		Expect(streamError.Code).To(Equal(responseCodeStreamNotAvailable))
+		Expect(streamError.Command).To(Equal("CommandDeclarePublisher"))
+		Expect(streamError.Stream).To(Equal("orders"))
+		Expect(streamError.Retryable()).To(BeTrue())
+
+		Expect(newStreamError(responseCodeAccessRefused, commandOpen, "").Error()).
+			To(Equal("Resources Access Refused, code: 16, command: commandOpen"))
+		Expect(newStreamError(responseCodeAccessRefused, commandOpen, "").Retryable()).To(BeFalse())
+
+		// the unknown code is resolved once, by newStreamError
+		unknown := newStreamError(1000, commandOpen, "")
+		Expect(unknown.Unwrap()).To(Equal(UnknownResponseCode))
+		Expect(unknown.Error()).To(HavePrefix(UnknownResponseCode.Error()))
+	})
+
+	It("Cover all the response codes", func() {
+		for code := responseCodeStreamDoesNotExist; code <= responseCodeOffsetNotFound; code++ {
+			Expect(lookErrorCode(code)).NotTo(Equal(UnknownResponseCode))
+		}
+		Expect(lookErrorCode(responseCodeOk)).To(BeNil())
+		Expect(lookErrorCode(1000)).To(Equal(UnknownResponseCode))
+	})
+
+})
@@ -2,13 +2,50 @@ package stream
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
+// LeaderLocator is the strategy used by the broker
+// to choose the node of the stream leader
+type LeaderLocator string
+
+const (
+	LeaderLocatorClientLocal  LeaderLocator = "client-local"
+	LeaderLocatorBalanced     LeaderLocator = "balanced"
+	LeaderLocatorLeastLeaders LeaderLocator = "least-leaders"
+	LeaderLocatorRandom       LeaderLocator = "random"
+)
+
+const (
+	streamArgumentLeaderLocator      = "queue-leader-locator"
+	streamArgumentInitialClusterSize = "initial-cluster-size"
+	streamArgumentMaxLengthBytes     = "max-length-bytes"
+	streamArgumentMaxSegmentSize     = "stream-max-segment-size-bytes"
+	streamArgumentMaxAge             = "max-age"
+	streamArgumentFilterSizeBytes    = "stream-filter-size-bytes"
+
+	maxSegmentSizeBytes = 3_000_000_000
+	minFilterSizeBytes  = 16
+	maxFilterSizeBytes  = 255
+)
+
 type StreamOptions struct {
 	MaxAge              time.Duration
 	MaxLengthBytes      *ByteCapacity
 	MaxSegmentSizeBytes *ByteCapacity
+	// InitialClusterSize is the number of nodes (leader + replicas),
+	// 0 is the broker default
+	InitialClusterSize int
+	// LeaderLocator, least-leaders when empty
+	LeaderLocator LeaderLocator
+	// FilterSizeBytes is the size of the bloom filter used by
+	// the broker side filtering, 0 is the broker default
+	FilterSizeBytes int
+	// Arguments are sent as they are, for the settings not covered
+	// by the fields above
+	Arguments map[string]string
 }
 
 func (s *StreamOptions) SetMaxAge(maxAge time.Duration) *StreamOptions {
@@ -26,8 +63,40 @@ func (s *StreamOptions) SetMaxSegmentSizeBytes(segmentSize *ByteCapacity) *Strea
 	return s
 }
 
+func (s *StreamOptions) SetInitialClusterSize(initialClusterSize int) *StreamOptions {
+	s.InitialClusterSize = initialClusterSize
+	return s
+}
+
+func (s *StreamOptions) SetLeaderLocator(leaderLocator LeaderLocator) *StreamOptions {
+	s.LeaderLocator = leaderLocator
+	return s
+}
+
+func (s *StreamOptions) SetFilterSizeBytes(filterSizeBytes int) *StreamOptions {
+	s.FilterSizeBytes = filterSizeBytes
+	return s
+}
+
+func (s *StreamOptions) SetArgument(key string, value string) *StreamOptions {
+	if s.Arguments == nil {
+		s.Arguments = map[string]string{}
+	}
+	s.Arguments[key] = value
+	return s
+}
+
 func (s StreamOptions) buildParameters() (map[string]string, error) {
-	res := map[string]string{"queue-leader-locator": "least-leaders"}
+	leaderLocator := LeaderLocatorLeastLeaders
+	if s.LeaderLocator != "" {
+		leaderLocator = s.LeaderLocator
+	}
+	switch leaderLocator {
+	case LeaderLocatorClientLocal, LeaderLocatorBalanced, LeaderLocatorLeastLeaders, LeaderLocatorRandom:
+	default:
+		return nil, fmt.Errorf("invalid LeaderLocator: %s", leaderLocator)
+	}
+	res := map[string]string{streamArgumentLeaderLocator: string(leaderLocator)}
 
 	if s.MaxLengthBytes != nil {
 		if s.MaxLengthBytes.error != nil {
@@ -35,7 +104,7 @@ func (s StreamOptions) buildParameters() (map[string]string, error) {
 		}
 
 		if s.MaxLengthBytes.bytes > 0 {
-			res["max-length-bytes"] = fmt.Sprintf("%d", s.MaxLengthBytes.bytes)
+			res[streamArgumentMaxLengthBytes] = fmt.Sprintf("%d", s.MaxLengthBytes.bytes)
 		}
 	}
 
@@ -44,17 +113,136 @@ func (s StreamOptions) buildParameters() (map[string]string, error) {
 			return nil, s.MaxSegmentSizeBytes.error
 		}
 
+		if s.MaxSegmentSizeBytes.bytes > maxSegmentSizeBytes {
+			return nil, fmt.Errorf("invalid MaxSegmentSizeBytes: %d, max value is %d",
+				s.MaxSegmentSizeBytes.bytes, maxSegmentSizeBytes)
+		}
+
 		if s.MaxSegmentSizeBytes.bytes > 0 {
-			res["stream-max-segment-size-bytes"] = fmt.Sprintf("%d", s.MaxSegmentSizeBytes.bytes)
+			res[streamArgumentMaxSegmentSize] = fmt.Sprintf("%d", s.MaxSegmentSizeBytes.bytes)
+		}
+
+		if s.MaxLengthBytes != nil && s.MaxLengthBytes.bytes > 0 &&
+			s.MaxSegmentSizeBytes.bytes > s.MaxLengthBytes.bytes {
+			return nil, fmt.Errorf("invalid MaxSegmentSizeBytes: %d, it can't be bigger than MaxLengthBytes: %d",
+				s.MaxSegmentSizeBytes.bytes, s.MaxLengthBytes.bytes)
 		}
 	}
 
+	if s.MaxAge < 0 || (s.MaxAge > 0 && s.MaxAge < time.Second) {
+		return nil, fmt.Errorf("invalid MaxAge: %s, min value is 1s", s.MaxAge)
+	}
 	if s.MaxAge > 0 {
-		res["max-age"] = fmt.Sprintf("%.0fs", s.MaxAge.Seconds())
+		res[streamArgumentMaxAge] = fmt.Sprintf("%.0fs", s.MaxAge.Seconds())
+	}
+
+	if s.InitialClusterSize < 0 {
+		return nil, fmt.Errorf("invalid InitialClusterSize: %d", s.InitialClusterSize)
+	}
+	if s.InitialClusterSize > 0 {
+		res[streamArgumentInitialClusterSize] = fmt.Sprintf("%d", s.InitialClusterSize)
+	}
+
+	if s.FilterSizeBytes != 0 &&
+		(s.FilterSizeBytes < minFilterSizeBytes || s.FilterSizeBytes > maxFilterSizeBytes) {
+		return nil, fmt.Errorf("invalid FilterSizeBytes: %d, it must be between %d and %d",
+			s.FilterSizeBytes, minFilterSizeBytes, maxFilterSizeBytes)
+	}
+	if s.FilterSizeBytes > 0 {
+		res[streamArgumentFilterSizeBytes] = fmt.Sprintf("%d", s.FilterSizeBytes)
+	}
+
+	for key, value := range s.Arguments {
+		if key == "" {
+			return nil, fmt.Errorf("stream argument key can't be empty")
+		}
+		switch key {
+		case streamArgumentLeaderLocator, streamArgumentInitialClusterSize, streamArgumentMaxLengthBytes,
+			streamArgumentMaxSegmentSize, streamArgumentMaxAge, streamArgumentFilterSizeBytes:
+			return nil, fmt.Errorf("stream argument %s is set by the StreamOptions fields", key)
+		}
+		res[key] = value
 	}
 	return res, nil
 }
 
+// setArguments are the arguments of the fields set by the caller,
+// without the default LeaderLocator, see StreamOptionsMismatch
+func (s StreamOptions) setArguments() (map[string]string, error) {
+	res, err := s.buildParameters()
+	if err != nil {
+		return nil, err
+	}
+	if s.LeaderLocator == "" {
+		delete(res, streamArgumentLeaderLocator)
+	}
+	return res, nil
+}
+
+// fieldNames maps the arguments built by buildParameters to the
+// StreamOptions fields, the custom Arguments are named Arguments[key]
+func (s StreamOptions) fieldNames(arguments map[string]string) []string {
+	names := map[string]string{
+		streamArgumentLeaderLocator:      "LeaderLocator",
+		streamArgumentInitialClusterSize: "InitialClusterSize",
+		streamArgumentMaxLengthBytes:     "MaxLengthBytes",
+		streamArgumentMaxSegmentSize:     "MaxSegmentSizeBytes",
+		streamArgumentMaxAge:             "MaxAge",
+		streamArgumentFilterSizeBytes:    "FilterSizeBytes",
+	}
+	var res []string
+	for key := range arguments {
+		if name, ok := names[key]; ok {
+			res = append(res, name)
+		} else {
+			res = append(res, fmt.Sprintf("Arguments[%s]", key))
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// StreamOptionsDiff is a StreamOptions field that differs
+// between the desired options and the existing stream
+type StreamOptionsDiff struct {
+	Field   string
+	Desired string
+	Actual  string
+}
+
+// StreamOptionsMismatch is returned by EnsureStream when the stream exists
+// with different options.
+// The broker doesn't return the options of an existing stream, the
+// metadata returns only the leader and the replicas, so Fields can only
+// contain InitialClusterSize; the other fields set in the desired options
+// are listed in Unverified.
+// errors.Is(err, PreconditionFailed) is true
+type StreamOptionsMismatch struct {
+	Stream     string
+	Fields     []StreamOptionsDiff
+	Unverified []string
+}
+
+func (e *StreamOptionsMismatch) Error() string {
+	var details []string
+	for _, diff := range e.Fields {
+		details = append(details, fmt.Sprintf("%s (desired: %s, actual: %s)",
+			diff.Field, diff.Desired, diff.Actual))
+	}
+	if len(e.Unverified) > 0 {
+		details = append(details, fmt.Sprintf("unverified: %s", strings.Join(e.Unverified, ", ")))
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("stream %s already exists with different options", e.Stream)
+	}
+	return fmt.Sprintf("stream %s already exists with different options: %s",
+		e.Stream, strings.Join(details, "; "))
+}
+
+func (e *StreamOptionsMismatch) Unwrap() error {
+	return PreconditionFailed
+}
+
 func NewStreamOptions() *StreamOptions {
 	return &StreamOptions{}
 }
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream options", func() {
+
+	It("Default parameters", func() {
+		params, err := NewStreamOptions().buildParameters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(params).To(Equal(map[string]string{"queue-leader-locator": "least-leaders"}))
+	})
+
+	It("All the parameters", func() {
+		params, err := NewStreamOptions().
+			SetMaxAge(2*time.Hour).
+			SetMaxLengthBytes(ByteCapacity{}.GB(10)).
+			SetMaxSegmentSizeBytes(ByteCapacity{}.MB(500)).
+			SetInitialClusterSize(3).
+			SetLeaderLocator(LeaderLocatorBalanced).
+			SetFilterSizeBytes(32).
+			SetArgument("custom", "value").
+			buildParameters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(params).To(Equal(map[string]string{
+			"queue-leader-locator":          "balanced",
+			"max-age":                       "7200s",
+			"max-length-bytes":              "10000000000",
+			"stream-max-segment-size-bytes": "500000000",
+			"initial-cluster-size":          "3",
+			"stream-filter-size-bytes":      "32",
+			"custom":                        "value",
+		}))
+	})
+
+	It("Validations", func() {
+		invalid := []*StreamOptions{
+			NewStreamOptions().SetLeaderLocator("nearest"),
+			NewStreamOptions().SetInitialClusterSize(-1),
+			NewStreamOptions().SetMaxAge(-time.Second),
+			NewStreamOptions().SetMaxAge(500 * time.Millisecond),
+			NewStreamOptions().SetMaxSegmentSizeBytes(ByteCapacity{}.GB(4)),
+			NewStreamOptions().SetMaxLengthBytes(ByteCapacity{}.MB(10)).
+				SetMaxSegmentSizeBytes(ByteCapacity{}.MB(20)),
+			NewStreamOptions().SetFilterSizeBytes(8),
+			NewStreamOptions().SetFilterSizeBytes(256),
+			NewStreamOptions().SetArgument("", "value"),
+			NewStreamOptions().SetArgument("max-age", "10s"),
+			NewStreamOptions().SetArgument("queue-leader-locator", "random"),
+		}
+		for _, options := range invalid {
+			_, err := options.buildParameters()
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("Mismatch error", func() {
+		var err error = &StreamOptionsMismatch{
+			Stream:     "orders",
+			Fields:     []StreamOptionsDiff{{Field: "InitialClusterSize", Desired: "3", Actual: "1"}},
+			Unverified: []string{"MaxAge"},
+		}
+		Expect(errors.Is(err, PreconditionFailed)).To(BeTrue())
+		Expect(err.Error()).To(Equal("stream orders already exists with different options: " +
+			"InitialClusterSize (desired: 3, actual: 1); unverified: MaxAge"))
+
+		names := NewStreamOptions().fieldNames(map[string]string{
+			"max-age": "10s", "queue-leader-locator": "balanced", "custom": "value"})
+		Expect(names).To(Equal([]string{"Arguments[custom]", "LeaderLocator", "MaxAge"}))
+
+		// the default LeaderLocator is not set by the caller
+		options := NewStreamOptions().SetMaxAge(time.Hour)
+		args, err := options.setArguments()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(options.fieldNames(args)).To(Equal([]string{"MaxAge"}))
+		args, err = options.SetLeaderLocator(LeaderLocatorBalanced).setArguments()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(options.fieldNames(args)).To(Equal([]string{"LeaderLocator", "MaxAge"}))
+		Expect((&StreamOptionsMismatch{Stream: "orders"}).Error()).
+			To(Equal("stream orders already exists with different options"))
+	})
+
+})
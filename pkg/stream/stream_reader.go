@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
+
+type StreamReaderOptions struct {
+	// Offset is where the reader starts, First by default
+	Offset OffsetSpecification
+	// Until is the last offset or timestamp read, see ConsumerOptions.SetUntil
+	Until OffsetSpecification
+	// StopAtTail stops the reader once it reads the messages that were in
+	// the stream when it opened. It needs a server with FeatureStreamStats.
+	StopAtTail bool
+	// BufferSize is the number of messages received before Next is called,
+	// the delivery on the reader connection waits when the buffer is full
+	BufferSize int
+}
+
+func NewStreamReaderOptions() *StreamReaderOptions {
+	return &StreamReaderOptions{
+		Offset:     OffsetSpecification{}.First(),
+		BufferSize: defaultReaderBufferSize,
+	}
+}
+
+func (o *StreamReaderOptions) SetOffset(offset OffsetSpecification) *StreamReaderOptions {
+	o.Offset = offset
+	return o
+}
+
+func (o *StreamReaderOptions) SetUntil(until OffsetSpecification) *StreamReaderOptions {
+	o.Until = until
+	return o
+}
+
+func (o *StreamReaderOptions) SetStopAtTail(stopAtTail bool) *StreamReaderOptions {
+	o.StopAtTail = stopAtTail
+	return o
+}
+
+func (o *StreamReaderOptions) SetBufferSize(bufferSize int) *StreamReaderOptions {
+	o.BufferSize = bufferSize
+	return o
+}
+
+type readerMessage struct {
+	message *amqp.Message
+	context MessageContext
+}
+
+// StreamReader reads the stream one message at a time with Next,
+// it is a consumer that waits for the reader. Next is not safe for
+// concurrent use.
+type StreamReader struct {
+	consumer *Consumer
+	messages chan readerMessage
+	closeCh  ChannelClose
+	// closed by Close, it releases the consumer handler
+	done      chan struct{}
+	closeOnce *sync.Once
+	// the error returned by Next when there are no more messages
+	endErr error
+}
+
+// NewStreamReader opens a reader on the stream. Next returns
+// EndOfStream after the Until bound or the tail, see StreamReaderOptions.
+func (env *Environment) NewStreamReader(streamName string, options *StreamReaderOptions) (*StreamReader, error) {
+	if options == nil {
+		options = NewStreamReaderOptions()
+	}
+	if options.BufferSize <= 0 {
+		return nil, fmt.Errorf("BufferSize must be positive")
+	}
+
+	reader := &StreamReader{
+		messages:  make(chan readerMessage, options.BufferSize),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	consumerOptions := NewConsumerOptions().SetOffset(options.Offset).SetUntil(options.Until)
+	if options.StopAtTail {
+		tail, err := env.tailChunkId(streamName)
+		if err != nil {
+			return nil, err
+		}
+		if tail < 0 {
+			// the stream is empty
+			reader.endErr = EndOfStream
+			return reader, nil
+		}
+		consumerOptions.stopAtTail = true
+		consumerOptions.tailChunkId = tail
+	}
+
+	consumer, err := env.NewConsumer(streamName, func(consumerContext ConsumerContext, message *amqp.Message) {
+		select {
+		case reader.messages <- readerMessage{message: message, context: consumerContext.Message}:
+		case <-reader.done:
+		}
+	}, consumerOptions)
+	if err != nil {
+		return nil, err
+	}
+	reader.consumer = consumer
+	reader.closeCh = consumer.NotifyClose()
+	if consumer.getStatus() == closed {
+		// closed before NotifyClose, for example at the tail
+		reader.endErr = reader.closeError(Event{Reason: "closed"})
+	}
+	return reader, nil
+}
+
+func (env *Environment) tailChunkId(streamName string) (int64, error) {
+	stats, err := env.StreamStats(streamName)
+	if err != nil {
+		return -1, err
+	}
+	return stats.CommittedChunkId()
+}
+
+// Next waits for the next message. It returns EndOfStream after the
+// last message, AlreadyClosed after Close and the context error when
+// the context is done first.
+func (r *StreamReader) Next(ctx context.Context) (*amqp.Message, MessageContext, error) {
+	for {
+		select {
+		case <-r.done:
+			return nil, MessageContext{}, AlreadyClosed
+		default:
+		}
+		select {
+		case msg := <-r.messages:
+			return msg.message, msg.context, nil
+		default:
+		}
+		// the messages received before the end are returned first
+		if r.endErr != nil {
+			return nil, MessageContext{}, r.endErr
+		}
+		select {
+		case msg := <-r.messages:
+			return msg.message, msg.context, nil
+		case event := <-r.closeCh:
+			r.endErr = r.closeError(event)
+		case <-r.done:
+			r.endErr = AlreadyClosed
+		case <-ctx.Done():
+			return nil, MessageContext{}, ctx.Err()
+		}
+	}
+}
+
+func (r *StreamReader) closeError(event Event) error {
+	if atomic.LoadInt32(&r.consumer.untilReached) == 1 {
+		return EndOfStream
+	}
+	if event.Err != nil {
+		return event.Err
+	}
+	return fmt.Errorf("stream reader closed: %s", event.Reason)
+}
+
+// Close stops the reader, the messages not read are discarded
+func (r *StreamReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		if r.consumer != nil {
+			err = r.consumer.Close()
+			if err == AlreadyClosed {
+				err = nil
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,94 @@
+package stream
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream reader", func() {
+	var (
+		env        *Environment
+		streamName string
+	)
+	BeforeEach(func() {
+		var err error
+		env, err = NewEnvironment(nil)
+		Expect(err).NotTo(HaveOccurred())
+		streamName = uuid.New().String()
+		Expect(env.DeclareStream(streamName, nil)).NotTo(HaveOccurred())
+		producer, err := env.NewProducer(streamName, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(producer.BatchSend(CreateArrayMessagesForTesting(100))).NotTo(HaveOccurred())
+		Eventually(producer.lenUnConfirmed, 5*time.Second).Should(Equal(0))
+		Expect(producer.Close()).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(env.DeleteStream(streamName)).NotTo(HaveOccurred())
+		Expect(env.Close()).NotTo(HaveOccurred())
+	})
+
+	It("Reads up to the Until offset", func() {
+		reader, err := env.NewStreamReader(streamName,
+			NewStreamReaderOptions().SetOffset(OffsetSpecification{}.Offset(10)).
+				SetUntil(OffsetSpecification{}.Offset(19)))
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for i := int64(10); i < 20; i++ {
+			message, messageContext, err := reader.Next(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messageContext.Offset).To(Equal(i))
+			Expect(messageContext.StreamName).To(Equal(streamName))
+			Expect(string(message.GetData())).To(Equal("test_" + strconv.FormatInt(i, 10)))
+		}
+		_, _, err = reader.Next(ctx)
+		Expect(err).To(MatchError(EndOfStream))
+		Expect(reader.Close()).NotTo(HaveOccurred())
+	})
+
+	It("Stops at the tail", func() {
+		locator, err := env.getLocator()
+		Expect(err).NotTo(HaveOccurred())
+		if !locator.SupportsFeature(FeatureStreamStats) {
+			Skip("the server doesn't return the stream stats")
+		}
+		reader, err := env.NewStreamReader(streamName, NewStreamReaderOptions().SetStopAtTail(true))
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		count := 0
+		for {
+			_, _, err := reader.Next(ctx)
+			if err != nil {
+				Expect(err).To(MatchError(EndOfStream))
+				break
+			}
+			count++
+		}
+		Expect(count).To(Equal(100))
+		Expect(reader.Close()).NotTo(HaveOccurred())
+	})
+
+	It("Next waits for the context and Close", func() {
+		reader, err := env.NewStreamReader(streamName,
+			NewStreamReaderOptions().SetOffset(OffsetSpecification{}.Next()))
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, _, err = reader.Next(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(reader.Close()).NotTo(HaveOccurred())
+		_, _, err = reader.Next(context.Background())
+		Expect(err).To(MatchError(AlreadyClosed))
+	})
+
+	It("Validation", func() {
+		_, err := env.NewStreamReader(streamName, NewStreamReaderOptions().SetBufferSize(0))
+		Expect(err).To(HaveOccurred())
+	})
+})
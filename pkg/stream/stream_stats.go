@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+)
+
+const (
+	streamStatFirstChunkId     = "first_chunk_id"
+	streamStatCommittedChunkId = "committed_chunk_id"
+)
+
+// StreamStats are the statistics of a stream returned by the server,
+// see Environment.StreamStats
+type StreamStats struct {
+	stats      map[string]int64
+	streamName string
+}
+
+// FirstOffset is the first offset of the stream,
+// -1 when the stream is empty
+func (s *StreamStats) FirstOffset() (int64, error) {
+	return s.get(streamStatFirstChunkId)
+}
+
+// CommittedChunkId is the first offset of the last chunk committed
+// by the stream replicas, -1 when the stream is empty.
+// The chunk can hold more messages, so it isn't the last offset.
+func (s *StreamStats) CommittedChunkId() (int64, error) {
+	return s.get(streamStatCommittedChunkId)
+}
+
+func (s *StreamStats) get(key string) (int64, error) {
+	value, ok := s.stats[key]
+	if !ok {
+		return -1, fmt.Errorf("stat %s not available for the stream: %s", key, s.streamName)
+	}
+	return value, nil
+}
+
+// StreamStats needs FeatureStreamStats
+func (c *Client) StreamStats(streamName string) (*StreamStats, error) {
+	if !c.SupportsFeature(FeatureStreamStats) {
+		return nil, fmt.Errorf("StreamStats needs a server with the stream stats")
+	}
+	length := 2 + 2 + 4 + 2 + len(streamName)
+	resp := c.coordinator.NewResponse(commandStreamStats, streamName)
+	correlationId := resp.correlationid
+	var b = bytes.NewBuffer(make([]byte, 0, length+4))
+	writeProtocolHeader(b, length, commandStreamStats,
+		correlationId)
+	writeString(b, streamName)
+
+	err := c.handleWriteWithResponse(b.Bytes(), resp, false)
+	if err.Err != nil {
+		if !err.isTimeout {
+			// the stats follow the code also in case of error
+			<-resp.data
+		}
+		_ = c.coordinator.RemoveResponseById(resp.correlationid)
+		return nil, err.Err
+	}
+
+	stats := <-resp.data
+	_ = c.coordinator.RemoveResponseById(resp.correlationid)
+	return &StreamStats{stats: stats.(map[string]int64), streamName: streamName}, nil
+}
+
+func (c *Client) streamStatsFrameHandler(readProtocol *ReaderProtocol, r *bufio.Reader) {
+	readProtocol.CorrelationId, _ = readUInt(r)
+	readProtocol.ResponseCode = uShortExtractResponseCode(readUShort(r))
+	statsCount, _ := readUInt(r)
+	stats := map[string]int64{}
+	for i := 0; i < int(statsCount); i++ {
+		key := readString(r)
+		stats[key] = readInt64(r)
+	}
+	res, err := c.coordinator.GetResponseById(readProtocol.CorrelationId)
+	if err != nil {
+		// TODO handle readProtocol
+		return
+	}
+	res.code <- Code{id: readProtocol.ResponseCode}
+	res.data <- stats
+}
@@ -37,7 +37,7 @@ func waitCodeWithTimeOut(response *Response, timeout time.Duration) responseErro
 	select {
 	case code := <-response.code:
 		if code.id != responseCodeOk {
-			return newResponseError(lookErrorCode(code.id), false)
+			return newResponseError(newStreamError(code.id, response.commandId, response.streamName), false)
 		}
 		return newResponseError(nil, false)
 	case <-time.After(timeout):
@@ -41,4 +41,12 @@ var _ = Describe("Utils", func() {
 		wg.Wait()
 	})
 
+	It("Negotiate tune values", func() {
+		Expect(negotiateTuneValue(60, 30)).To(Equal(30))
+		Expect(negotiateTuneValue(10, 60)).To(Equal(10))
+		Expect(negotiateTuneValue(0, 60)).To(Equal(60))
+		Expect(negotiateTuneValue(60, 0)).To(Equal(60))
+		Expect(negotiateTuneValue(0, 0)).To(Equal(0))
+	})
+
 })